@@ -0,0 +1,60 @@
+package cel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/luraproject/lura/v2/proxy"
+)
+
+// readReqBody decodes the JSON body of the request and restores it, so the next proxy receives
+// the same content. Bodies not containing a JSON object are exposed as an empty map and bodies
+// bigger than maxSize abort the request
+func readReqBody(r *proxy.Request, maxSize int64) (map[string]interface{}, error) {
+	body := map[string]interface{}{}
+	if r.Body == nil {
+		return body, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(buf)) > maxSize {
+		return nil, RejectionError{
+			Code:      http.StatusRequestEntityTooLarge,
+			Msg:       fmt.Sprintf("request body bigger than %d bytes", maxSize),
+			Evaluator: "req_body",
+		}
+	}
+
+	if len(buf) > 0 {
+		if err := json.Unmarshal(buf, &body); err != nil || body == nil {
+			return map[string]interface{}{}, nil
+		}
+	}
+	return body, nil
+}
+
+// readRespBody reads the streamed content of the response and restores it, so the next pipe
+// receives the same content. Responses without a stream are exposed as an empty body and only
+// the first maxSize bytes of the bigger ones are exposed
+func readRespBody(r *proxy.Response, maxSize int64) ([]byte, error) {
+	if r == nil || r.Io == nil {
+		return []byte{}, nil
+	}
+
+	original := r.Io
+	buf, err := io.ReadAll(io.LimitReader(original, maxSize))
+	r.Io = io.MultiReader(bytes.NewReader(buf), original)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,281 @@
+package cel
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/krakend/krakend-cel/v2/internal"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/logging"
+	"github.com/luraproject/lura/v2/proxy"
+)
+
+func TestProxyFactory_reqBody(t *testing.T) {
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				return nil, err
+			}
+			return &proxy.Response{Data: map[string]interface{}{"body": string(b)}, IsComplete: true}, nil
+		}, nil
+	})
+
+	prxy, err := ProxyFactory(logging.NoOp, pf).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: map[string]interface{}{
+				"req_body":      true,
+				"max_body_size": 32,
+				"rules": []interface{}{
+					map[string]interface{}{"check_expr": "!has(req_body.amount) || req_body.amount <= 10000"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, tc := range []struct {
+		body    string
+		success bool
+		status  int
+	}{
+		{body: `{"amount": 42}`, success: true},
+		{body: `{"amount": 10001}`},
+		{body: ``, success: true},
+		{body: `not a json`, success: true},
+		{body: `{"amount": 42, "description": "a very long description"}`, status: http.StatusRequestEntityTooLarge},
+	} {
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "POST",
+			Path:    "/some-path",
+			Headers: map[string][]string{},
+			Body:    io.NopCloser(strings.NewReader(tc.body)),
+		})
+		if !tc.success {
+			if err == nil {
+				t.Errorf("%s: expecting error", tc.body)
+			}
+			if rErr, ok := err.(RejectionError); tc.status != 0 && (!ok || rErr.StatusCode() != tc.status) {
+				t.Errorf("%s: unexpected error %v", tc.body, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.body, err)
+			continue
+		}
+		if resp.Data["body"] != tc.body {
+			t.Errorf("%s: the body was not restored: %v", tc.body, resp.Data["body"])
+		}
+	}
+}
+
+func TestProxyFactory_reqBody_disabled(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "has(req_body.amount)"},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := prxy(context.Background(), &proxy.Request{
+		Method: "POST",
+		Body:   io.NopCloser(strings.NewReader(`{"amount": 42}`)),
+	}); err == nil {
+		t.Error("expecting error")
+	}
+}
+
+func TestProxyFactory_respBody(t *testing.T) {
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{Io: strings.NewReader(r.Params["Body"]), IsComplete: true}, nil
+		}, nil
+	})
+
+	prxy, err := ProxyFactory(logging.NoOp, pf).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: map[string]interface{}{
+				"resp_body":     true,
+				"max_body_size": 32,
+				"rules": []interface{}{
+					map[string]interface{}{"check_expr": "!string(resp_body).contains('secret')"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, tc := range []struct {
+		body    string
+		success bool
+		status  int
+	}{
+		{body: `id,name\n1,foo`, success: true},
+		{body: ``, success: true},
+		{body: `id,name\n1,secret`},
+		// only the first 32 bytes of the bigger bodies are checked
+		{body: `id,name\n1,foo\n2,bar\n3,baz\n4,qux\n5,secret\n`, success: true},
+		{body: `id,name\n1,secret\n2,bar\n3,baz\n4,qux\n`},
+	} {
+		resp, err := prxy(context.Background(), &proxy.Request{Params: map[string]string{"Body": tc.body}})
+		if !tc.success {
+			if err == nil {
+				t.Errorf("%s: expecting error", tc.body)
+			}
+			if rErr, ok := err.(RejectionError); tc.status != 0 && (!ok || rErr.StatusCode() != tc.status) {
+				t.Errorf("%s: unexpected error %v", tc.body, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.body, err)
+			continue
+		}
+		b, _ := io.ReadAll(resp.Io)
+		if string(b) != tc.body {
+			t.Errorf("%s: the body was not restored: %s", tc.body, string(b))
+		}
+	}
+}
+
+func TestProxyFactory_respBody_unused(t *testing.T) {
+	stream := &countingReader{Reader: strings.NewReader(strings.Repeat("x", 64))}
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{Io: stream, IsComplete: true}, nil
+		}, nil
+	})
+
+	prxy, err := ProxyFactory(logging.NoOp, pf).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: map[string]interface{}{
+				"resp_body":     true,
+				"max_body_size": 32,
+				"rules": []interface{}{
+					map[string]interface{}{"check_expr": "resp_completed"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := prxy(context.Background(), &proxy.Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.read != 0 {
+		t.Errorf("the body was read by the proxy: %d bytes", stream.read)
+	}
+	if b, _ := io.ReadAll(resp.Io); len(b) != 64 {
+		t.Errorf("unexpected body size %d", len(b))
+	}
+}
+
+func TestProxyFactory_respBody_group(t *testing.T) {
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{Io: strings.NewReader(r.Params["Body"]), IsComplete: true}, nil
+		}, nil
+	})
+
+	prxy, err := ProxyFactory(logging.NoOp, pf).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: map[string]interface{}{
+				"resp_body": true,
+				"rules": []interface{}{
+					map[string]interface{}{"not": map[string]interface{}{"check_expr": "string(resp_body).contains('secret')"}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := prxy(context.Background(), &proxy.Request{Params: map[string]string{"Body": "foo"}}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := prxy(context.Background(), &proxy.Request{Params: map[string]string{"Body": "secret"}}); err == nil {
+		t.Error("expecting error")
+	}
+}
+
+type countingReader struct {
+	io.Reader
+	read int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.read += n
+	return n, err
+}
+
+func TestProxyFactory_respCollection(t *testing.T) {
+	expectedResponse := &proxy.Response{
+		Data: map[string]interface{}{
+			"collection": []interface{}{
+				map[string]interface{}{"id": 1, "owner": "alice"},
+				map[string]interface{}{"id": 2, "owner": "bob"},
+			},
+		},
+		IsComplete: true,
+	}
+
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "size(resp_collection) > 0 && resp_collection.all(i, has(i.owner))"},
+				{ModExpression: "{'resp_collection': resp_collection.filter(i, i.owner == 'bob')}"},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := prxy(context.Background(), &proxy.Request{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	items, ok := resp.Data["collection"].([]interface{})
+	if !ok || len(items) != 1 {
+		t.Errorf("unexpected collection: %v", resp.Data["collection"])
+		return
+	}
+	if item, ok := items[0].(map[string]interface{}); !ok || item["owner"] != "bob" {
+		t.Errorf("unexpected item: %v", items[0])
+	}
+
+	expectedResponse.Data = map[string]interface{}{"foo": "bar"}
+	if _, err := prxy(context.Background(), &proxy.Request{}); err == nil {
+		t.Error("expecting error: the response is not a collection")
+	}
+}
@@ -0,0 +1,291 @@
+// Package celtest runs the CEL rules of an endpoint against a set of request fixtures with
+// their expected outcomes. The fixtures go through the proxies and the JWT rejecter built by
+// the module for the gateway, so the policies can be tested without starting it
+package celtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	cel "github.com/krakend/krakend-cel/v2"
+	"github.com/krakend/krakend-cel/v2/internal"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/logging"
+	"github.com/luraproject/lura/v2/proxy"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+var ErrUnknownExpectation = errors.New("celtest: the expected outcome must be allow or deny")
+
+// Suite is a set of fixtures evaluated against the rules of an endpoint
+type Suite struct {
+	// Service is the service level config of the module, declaring the shared constants,
+	// macros and named rules
+	Service interface{} `json:"service"`
+	// Rules is the extra config of the endpoint, in any of the formats accepted by the module
+	Rules    interface{} `json:"rules"`
+	Fixtures []Fixture   `json:"fixtures"`
+	// Dir is the directory used to resolve the relative paths of the policy files and bundles
+	Dir string `json:"-"`
+}
+
+// Fixture is a request with its expected outcome
+type Fixture struct {
+	Name    string              `json:"name"`
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Headers map[string][]string `json:"headers"`
+	Params  map[string]string   `json:"params"`
+	Query   map[string][]string `json:"query"`
+	// Body is sent as the JSON encoded request body
+	Body interface{} `json:"body"`
+	// JWT are the claims evaluated by the rejecter. Fixtures without claims skip it
+	JWT map[string]interface{} `json:"jwt"`
+	// Now is the time exposed as the now variable. Defaults to the current time
+	Now time.Time `json:"now"`
+	// Response is the response of the backends, used by the rules of the post phase
+	Response *Response `json:"response"`
+	// Expect is the expected outcome: allow or deny
+	Expect string `json:"expect"`
+	// Status is the expected status code of a denied request. Zero accepts any status
+	Status int `json:"status"`
+}
+
+// Response is the response returned by the backends of a fixture. Defaults to an empty and
+// completed response with a 200 status code
+type Response struct {
+	Status  int                    `json:"status"`
+	Headers map[string][]string    `json:"headers"`
+	Data    map[string]interface{} `json:"data"`
+	// Body is the streamed content of the response, used by the rules reading the resp_body
+	Body string `json:"body"`
+}
+
+// Result is the outcome of the evaluation of a fixture
+type Result struct {
+	Fixture Fixture
+	Allowed bool
+	// Status is the status code the gateway would return for a denied request
+	Status int
+	// Err is the error rejecting the request
+	Err error
+}
+
+// Passed returns true if the outcome matches the expected one
+func (r Result) Passed() bool {
+	if r.Allowed {
+		return r.Fixture.Expect == Allow
+	}
+	return r.Fixture.Expect == Deny && (r.Fixture.Status == 0 || r.Fixture.Status == r.Status)
+}
+
+func (r Result) String() string {
+	got := Allow
+	if !r.Allowed {
+		got = fmt.Sprintf("%s (%d: %v)", Deny, r.Status, r.Err)
+	}
+	want := r.Fixture.Expect
+	if want == Deny && r.Fixture.Status != 0 {
+		want = fmt.Sprintf("%s (%d)", Deny, r.Fixture.Status)
+	}
+	return fmt.Sprintf("%s: want %s, got %s", r.Fixture.Name, want, got)
+}
+
+// Load reads a YAML or JSON suite. The relative paths of the rules are resolved from the
+// directory of the file
+func Load(path string) (Suite, error) {
+	var s Suite
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+
+	var content interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &content)
+	default:
+		err = json.Unmarshal(b, &content)
+	}
+	if err != nil {
+		return s, fmt.Errorf("celtest: %s: %w", path, err)
+	}
+
+	// the suite is decoded through JSON, so the rules get the same types as the extra config
+	if b, err = json.Marshal(content); err != nil {
+		return s, fmt.Errorf("celtest: %s: %w", path, err)
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("celtest: %s: %w", path, err)
+	}
+	s.Dir = filepath.Dir(path)
+	return s, nil
+}
+
+// Run builds the proxy and the JWT rejecter of the rules in strict mode and evaluates all the
+// fixtures. It returns an error if the rules or the fixtures are not valid
+func (s Suite) Run(l logging.Logger, opts ...cel.Option) ([]Result, error) {
+	for i, f := range s.Fixtures {
+		if f.Expect != Allow && f.Expect != Deny {
+			return nil, fmt.Errorf("fixture #%d %s: %w", i, f.Name, ErrUnknownExpectation)
+		}
+	}
+
+	var now time.Time
+	var current *Fixture
+	opts = append(opts,
+		cel.WithStrictMode(true),
+		cel.WithConfigDir(s.Dir),
+		cel.WithClock(func() time.Time { return now }),
+	)
+	if s.Service != nil {
+		opts = append(opts, cel.WithServiceConfig(config.ExtraConfig{internal.Namespace: s.Service}))
+	}
+
+	cfg := &config.EndpointConfig{
+		Endpoint:    "/",
+		Method:      http.MethodGet,
+		ExtraConfig: config.ExtraConfig{internal.Namespace: s.Rules},
+	}
+
+	// the rejecter reports the invalid rules as fatal errors, so they are recorded instead
+	rec := &fatalRecorder{Logger: l}
+	rejecter := cel.NewRejecter(rec, cfg, opts...)
+	if rec.err != nil {
+		return nil, rec.err
+	}
+
+	backend := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return current.ProxyResponse(), nil
+		}, nil
+	})
+	p, err := cel.ProxyFactory(l, backend, opts...).New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]Result, len(s.Fixtures))
+	for i := range s.Fixtures {
+		current = &s.Fixtures[i]
+		now = current.Now
+		if now.IsZero() {
+			now = time.Now()
+		}
+		results[i] = Result{Fixture: *current, Allowed: true}
+
+		if rejecter != nil && current.JWT != nil && rejecter.Reject(current.JWT) {
+			// the JWT validator rejects the requests with an unauthorized status
+			results[i].Allowed = false
+			results[i].Status = http.StatusUnauthorized
+			results[i].Err = errors.New("rejected by the JWT rejecter")
+			continue
+		}
+
+		req, err := current.ProxyRequest()
+		if err != nil {
+			return nil, fmt.Errorf("fixture #%d %s: %w", i, current.Name, err)
+		}
+		if _, err := p(context.Background(), req); err != nil {
+			results[i].Allowed = false
+			results[i].Status = statusCode(err)
+			results[i].Err = err
+		}
+	}
+	return results, nil
+}
+
+// ProxyRequest returns the request of the fixture as received by the proxies, with the body
+// JSON encoded
+func (f *Fixture) ProxyRequest() (*proxy.Request, error) {
+	r := &proxy.Request{
+		Method:  f.Method,
+		Path:    f.Path,
+		Params:  f.Params,
+		Headers: f.Headers,
+		Query:   f.Query,
+	}
+	if r.Method == "" {
+		r.Method = http.MethodGet
+	}
+	if r.Path == "" {
+		r.Path = "/"
+	}
+	if r.Params == nil {
+		r.Params = map[string]string{}
+	}
+	if r.Headers == nil {
+		r.Headers = map[string][]string{}
+	}
+	if r.Query == nil {
+		r.Query = map[string][]string{}
+	}
+	if f.Body != nil {
+		b, err := json.Marshal(f.Body)
+		if err != nil {
+			return nil, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(b))
+	}
+	return r, nil
+}
+
+// ProxyResponse returns the response of the backends of the fixture
+func (f *Fixture) ProxyResponse() *proxy.Response {
+	resp := &proxy.Response{
+		Data:       map[string]interface{}{},
+		IsComplete: true,
+		Metadata: proxy.Metadata{
+			StatusCode: http.StatusOK,
+			Headers:    map[string][]string{},
+		},
+	}
+	if f.Response == nil {
+		return resp
+	}
+	if f.Response.Status != 0 {
+		resp.Metadata.StatusCode = f.Response.Status
+	}
+	if f.Response.Headers != nil {
+		resp.Metadata.Headers = f.Response.Headers
+	}
+	if f.Response.Data != nil {
+		resp.Data = f.Response.Data
+	}
+	if f.Response.Body != "" {
+		resp.Io = strings.NewReader(f.Response.Body)
+	}
+	return resp
+}
+
+// statusCode returns the status code the router would send for the error
+func statusCode(err error) int {
+	var sc interface{ StatusCode() int }
+	if errors.As(err, &sc) {
+		return sc.StatusCode()
+	}
+	return http.StatusInternalServerError
+}
+
+type fatalRecorder struct {
+	logging.Logger
+	err error
+}
+
+func (f *fatalRecorder) Fatal(v ...interface{}) {
+	f.err = errors.New(strings.TrimSpace(fmt.Sprintln(v...)))
+}
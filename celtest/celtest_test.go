@@ -0,0 +1,116 @@
+package celtest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/luraproject/lura/v2/logging"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "admin.cel"), []byte("// admins only\nreq_headers['X-Role'][0] == 'admin'"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	suite := `
+service:
+  constants:
+    max_items: 2
+rules:
+  req_body: true
+  rules:
+    - check_file: admin.cel
+      status_code: 403
+    - check_expr: "'sub' in JWT && JWT.sub != 'banned'"
+    - check_expr: req_method == 'GET' || has(req_body.id)
+      status_code: 400
+    - check_expr: now < timestamp('2030-01-01T00:00:00Z')
+      phase: pre
+    - check_expr: "!has(resp_data.items) || size(resp_data.items) <= max_items"
+      status_code: 502
+fixtures:
+  - name: admin
+    headers: {X-Role: [admin]}
+    jwt: {sub: alice}
+    now: 2025-01-01T00:00:00Z
+    expect: allow
+  - name: user
+    headers: {X-Role: [user]}
+    now: 2025-01-01T00:00:00Z
+    expect: deny
+    status: 403
+  - name: banned
+    headers: {X-Role: [admin]}
+    jwt: {sub: banned}
+    expect: deny
+    status: 401
+  - name: body
+    method: POST
+    headers: {X-Role: [admin]}
+    body: {id: 42}
+    now: 2025-01-01T00:00:00Z
+    expect: allow
+  - name: missing body
+    method: POST
+    headers: {X-Role: [admin]}
+    now: 2025-01-01T00:00:00Z
+    expect: deny
+    status: 400
+  - name: expired
+    headers: {X-Role: [admin]}
+    now: 2031-01-01T00:00:00Z
+    expect: deny
+  - name: too many items
+    headers: {X-Role: [admin]}
+    now: 2025-01-01T00:00:00Z
+    response:
+      data: {items: [1, 2, 3]}
+    expect: deny
+    status: 502
+  - name: wrong expectation
+    headers: {X-Role: [admin]}
+    now: 2031-01-01T00:00:00Z
+    expect: allow
+`
+	path := filepath.Join(dir, "suite.yaml")
+	if err := os.WriteFile(path, []byte(suite), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := s.Run(logging.NoOp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(s.Fixtures) {
+		t.Fatalf("unexpected number of results: %d", len(results))
+	}
+	for _, r := range results[:len(results)-1] {
+		if !r.Passed() {
+			t.Errorf("unexpected result: %s", r)
+		}
+	}
+	if r := results[len(results)-1]; r.Passed() {
+		t.Errorf("the last fixture should fail: %s", r)
+	}
+}
+
+func TestSuite_Run_wrongRules(t *testing.T) {
+	for _, s := range []Suite{
+		{Rules: []interface{}{map[string]interface{}{"check_expr": "req_method =="}}},
+		{Rules: []interface{}{map[string]interface{}{"check_expr": "JWT.sub == 1 +"}}},
+		{Rules: []interface{}{map[string]interface{}{"check_file": "missing.cel"}}, Dir: t.TempDir()},
+		{
+			Rules:    []interface{}{map[string]interface{}{"check_expr": "req_method == 'GET'"}},
+			Fixtures: []Fixture{{Name: "unknown", Expect: "maybe"}},
+		},
+	} {
+		if _, err := s.Run(logging.NoOp); err == nil {
+			t.Errorf("expecting error with %v", s.Rules)
+		}
+	}
+}
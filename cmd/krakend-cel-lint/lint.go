@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/krakend/krakend-cel/v2/internal"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/logging"
+)
+
+var (
+	endpointPhases = internal.Phases{internal.PrePhase, internal.PostPhase, internal.JwtPhase, internal.ClaimsPhase}
+	backendPhases  = internal.Phases{internal.PrePhase, internal.PostPhase}
+	// modifiers are not applied by the JWT rejecter
+	modPhases = internal.Phases{internal.PrePhase, internal.PostPhase}
+)
+
+type issue struct {
+	location string
+	rule     string
+	field    string
+	msg      string
+}
+
+func (i issue) String() string {
+	parts := []string{i.location}
+	if i.rule != "" {
+		parts = append(parts, i.rule)
+	}
+	if i.field != "" {
+		parts = append(parts, i.field)
+	}
+	return strings.Join(parts, " ") + ": " + i.msg
+}
+
+// linter validates the definitions. The claims variables are the names used by the claims
+// rejecters of the gateway, so the definitions referencing them can be checked. The cost limit
+// is the default limit of the gateway for the definitions not declaring their own. The service
+// config declares the constants, macros and named rules shared by all the definitions and the
+// dir is the one used to resolve the relative paths of the policy files
+type linter struct {
+	claims    []string
+	costLimit uint64
+	service   internal.Config
+	dir       string
+}
+
+func (l linter) lint(cfg config.ServiceConfig) []issue {
+	var res []issue
+	if _, ok := cfg.ExtraConfig[internal.Namespace]; ok {
+		svc, ok := internal.ConfigGetter(cfg.ExtraConfig)
+		if !ok {
+			return []issue{{location: "[SERVICE]", msg: "unable to decode the configuration"}}
+		}
+		svc, err := svc.Resolve(l.dir)
+		if err != nil {
+			return []issue{{location: "[SERVICE]", msg: err.Error()}}
+		}
+		if _, err := internal.NewLibrary(svc); err != nil {
+			return []issue{{location: "[SERVICE]", msg: err.Error()}}
+		}
+		l.service = svc
+	}
+
+	for _, e := range cfg.Endpoints {
+		location := fmt.Sprintf("[ENDPOINT: %s %s]", e.Method, e.Endpoint)
+		res = append(res, l.lintExtraConfig(location, e.ExtraConfig, endpointPhases)...)
+
+		for i, b := range e.Backend {
+			backendLocation := fmt.Sprintf("%s[BACKEND #%d: %s]", location, i, b.URLPattern)
+			res = append(res, l.lintExtraConfig(backendLocation, b.ExtraConfig, backendPhases)...)
+		}
+	}
+	return res
+}
+
+func (l linter) lintExtraConfig(location string, extra config.ExtraConfig, available internal.Phases) []issue {
+	if _, ok := extra[internal.Namespace]; !ok {
+		return nil
+	}
+	cfg, ok := internal.ConfigGetter(extra)
+	if !ok {
+		return []issue{{location: location, msg: "unable to decode the configuration"}}
+	}
+	cfg, err := cfg.Resolve(l.dir)
+	if err != nil {
+		return []issue{{location: location, msg: err.Error()}}
+	}
+	lib, err := internal.NewLibrary(l.service, cfg)
+	if err != nil {
+		return []issue{{location: location, msg: err.Error()}}
+	}
+
+	var res []issue
+	for i, def := range cfg.Definitions {
+		rule := fmt.Sprintf("rule #%d", i)
+		if def.Name != "" {
+			rule = fmt.Sprintf("rule %q", def.Name)
+		}
+
+		for _, phase := range def.Phase {
+			switch {
+			case !endpointPhases.Contains(phase):
+				res = append(res, issue{location, rule, "phase", internal.ErrUnknownPhase(phase).Error()})
+			case !available.Contains(phase):
+				res = append(res, issue{location, rule, "phase", fmt.Sprintf("the %s phase is unreachable at this level", phase)})
+			}
+		}
+
+		switch def.Mode {
+		case "", internal.EnforceMode:
+		case internal.AuditMode:
+			// the groups are checks too, so they can be audited
+			if def.CheckExpression == "" && !def.IsGroup() {
+				res = append(res, issue{location, rule, "mode", "the audit mode only applies to the check_expr"})
+			}
+		default:
+			res = append(res, issue{location, rule, "mode", internal.ErrUnknownMode(def.Mode).Error()})
+		}
+
+		if !def.HasValidStatusCode() {
+			res = append(res, issue{location, rule, "status_code", internal.ErrInvalidStatusCode(def.StatusCode).Error()})
+		}
+
+		if def.IsGroup() {
+			p := internal.NewCheckExpressionParser(logging.NoOp).WithCostLimit(l.costLimit).WithLibrary(lib).
+				WithClaimsVariables(l.claims...)
+			res = append(res, l.lintGroup(location, rule, p, def, available)...)
+			continue
+		}
+
+		if def.CheckExpression == "" && def.ModExpression == "" {
+			res = append(res, issue{location, rule, "", "unused definition: no check_expr nor mod_expr declared"})
+			continue
+		}
+
+		if def.CheckExpression != "" {
+			p := internal.NewCheckExpressionParser(logging.NoOp).WithCostLimit(l.costLimit).WithLibrary(lib).
+				WithClaimsVariables(l.claims...)
+			res = append(res, l.lintExpression(location, rule, "check_expr", p, def, available)...)
+		}
+		if def.ModExpression != "" {
+			p := internal.NewModExpressionParser(logging.NoOp).WithCostLimit(l.costLimit).WithLibrary(lib).
+				WithClaimsVariables(l.claims...)
+			res = append(res, l.lintExpression(location, rule, "mod_expr", p, def, intersect(available, modPhases))...)
+		}
+	}
+	return res
+}
+
+func (l linter) lintExpression(location, rule, field string, p internal.Parser, def internal.InterpretableDefinition, available internal.Phases) []issue {
+	ast, err := p.Compile(def)
+	if err != nil {
+		return []issue{{location, rule, field, err.Error()}}
+	}
+
+	var res []issue
+	switch kind := ast.OutputType().Kind(); {
+	case kind == types.DynKind:
+	case field == "check_expr" && kind != types.BoolKind:
+		res = append(res, issue{location, rule, field, fmt.Sprintf("the expression returns %s instead of bool", ast.OutputType())})
+	case field == "mod_expr" && kind != types.MapKind:
+		res = append(res, issue{location, rule, field, fmt.Sprintf("the expression returns %s instead of a map", ast.OutputType())})
+	}
+
+	if err := p.CheckPhases(ast); err != nil {
+		res = append(res, issue{location, rule, field, err.Error()})
+	}
+	return append(res, lintPhases(location, rule, field, def, p.InferPhases(ast), available)...)
+}
+
+// lintGroup validates a definition composed from other rules
+func (l linter) lintGroup(location, rule string, p internal.Parser, def internal.InterpretableDefinition, available internal.Phases) []issue {
+	referenced, err := p.CompileGroup(def)
+	if err != nil {
+		return []issue{{location, rule, "group", err.Error()}}
+	}
+	return lintPhases(location, rule, "group", def, referenced, available)
+}
+
+// lintPhases reports the definitions without a phase, the ones never evaluated at this level
+// and the ones referencing variables of several phases
+func lintPhases(location, rule, field string, def internal.InterpretableDefinition, referenced, available internal.Phases) []issue {
+	phases := def.Phase
+	if len(phases) == 0 {
+		if len(referenced) == 0 {
+			return []issue{{location, rule, field, internal.ErrNoPhase.Error()}}
+		}
+		phases = referenced
+	}
+	evaluated := intersect(phases, available)
+	if len(evaluated) == 0 {
+		return []issue{{location, rule, field, "unused definition: the expression is never evaluated at this level"}}
+	}
+
+	var res []issue
+	for _, phase := range evaluated {
+		for _, ref := range referenced {
+			if ref != phase {
+				res = append(res, issue{location, rule, field, fmt.Sprintf("the variables of the %s phase are not available in the %s phase", ref, phase)})
+			}
+		}
+	}
+	return res
+}
+
+func intersect(a, b internal.Phases) internal.Phases {
+	var res internal.Phases
+	for _, v := range a {
+		if b.Contains(v) {
+			res = append(res, v)
+		}
+	}
+	return res
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/krakend/krakend-cel/v2/internal"
+	"github.com/luraproject/lura/v2/config"
+)
+
+func TestLint(t *testing.T) {
+	cfg := config.ServiceConfig{
+		Endpoints: []*config.EndpointConfig{
+			{
+				Endpoint: "/foo",
+				Method:   "GET",
+				ExtraConfig: config.ExtraConfig{
+					internal.Namespace: []interface{}{
+						map[string]interface{}{"check_expr": "req_method == 'GET'"},
+						map[string]interface{}{"check_expr": "has(JWT.sub)"},
+						map[string]interface{}{"name": "syntax", "check_expr": "req_method =="},
+						map[string]interface{}{"name": "types", "check_expr": "req_method == 42"},
+						map[string]interface{}{"name": "not-bool", "check_expr": "req_method"},
+						map[string]interface{}{"name": "mixed", "check_expr": "req_method == 'GET' && resp_completed"},
+						map[string]interface{}{"name": "no-phase", "check_expr": "now_str != ''"},
+						map[string]interface{}{"name": "empty"},
+						map[string]interface{}{"name": "unknown", "check_expr": "req_method == 'GET'", "phase": "before"},
+						map[string]interface{}{"name": "jwt-mod", "mod_expr": "{'JWT': JWT}"},
+						map[string]interface{}{"name": "audit", "check_expr": "req_method == 'GET'", "mode": "audit"},
+						map[string]interface{}{"name": "audit-mod", "mod_expr": "{'req_path': req_path + '/'}", "mode": "audit"},
+						map[string]interface{}{"name": "dry-run", "check_expr": "req_method == 'GET'", "mode": "dry-run"},
+						map[string]interface{}{"name": "static-mod", "mod_expr": "{'resp_metadata_headers': {'X-Frame-Options': ['DENY']}}"},
+						map[string]interface{}{"name": "mixed-mod", "mod_expr": "{'resp_metadata_headers': {'X-Path': [req_path]}}"},
+						map[string]interface{}{"name": "bad-status", "check_expr": "req_method == 'GET'", "status_code": 42},
+					},
+				},
+				Backend: []*config.Backend{
+					{
+						URLPattern: "/bar",
+						ExtraConfig: config.ExtraConfig{
+							internal.Namespace: []interface{}{
+								map[string]interface{}{"mod_expr": "{'resp_completed': true}", "phase": "post"},
+								map[string]interface{}{"name": "backend-jwt", "check_expr": "has(JWT.sub)"},
+							},
+						},
+					},
+					{
+						URLPattern: "/baz",
+						ExtraConfig: config.ExtraConfig{
+							internal.Namespace: "req_method == 'GET'",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	expected := []string{
+		`[ENDPOINT: GET /foo] rule "syntax" check_expr: error parsing the expression`,
+		`[ENDPOINT: GET /foo] rule "types" check_expr: error parsing the expression`,
+		`[ENDPOINT: GET /foo] rule "not-bool" check_expr: the expression returns string instead of bool`,
+		`[ENDPOINT: GET /foo] rule "mixed" check_expr: the variables of the post phase are not available in the pre phase`,
+		`[ENDPOINT: GET /foo] rule "mixed" check_expr: the variables of the pre phase are not available in the post phase`,
+		`[ENDPOINT: GET /foo] rule "no-phase" check_expr: cel: unable to infer the phase of the expression`,
+		`[ENDPOINT: GET /foo] rule "empty": unused definition: no check_expr nor mod_expr declared`,
+		`[ENDPOINT: GET /foo] rule "unknown" phase: cel: unknown phase "before"`,
+		`[ENDPOINT: GET /foo] rule "unknown" check_expr: unused definition: the expression is never evaluated at this level`,
+		`[ENDPOINT: GET /foo] rule "jwt-mod" mod_expr: unused definition: the expression is never evaluated at this level`,
+		`[ENDPOINT: GET /foo] rule "audit-mod" mode: the audit mode only applies to the check_expr`,
+		`[ENDPOINT: GET /foo] rule "dry-run" mode: cel: unknown mode "dry-run"`,
+		`[ENDPOINT: GET /foo] rule "mixed-mod" mod_expr: cel: the modifier updates the variables of a phase other than the one it reads: reads pre, updates post`,
+		`[ENDPOINT: GET /foo] rule "bad-status" status_code: cel: invalid status code 42`,
+		`[ENDPOINT: GET /foo][BACKEND #0: /bar] rule "backend-jwt" check_expr: unused definition: the expression is never evaluated at this level`,
+		`[ENDPOINT: GET /foo][BACKEND #1: /baz]: unable to decode the configuration`,
+	}
+
+	issues := linter{}.lint(cfg)
+	if len(issues) != len(expected) {
+		for _, i := range issues {
+			t.Log(i)
+		}
+		t.Errorf("unexpected number of issues. have %d, want %d", len(issues), len(expected))
+		return
+	}
+	for i, e := range expected {
+		if !strings.HasPrefix(issues[i].String(), e) {
+			t.Errorf("#%d unexpected issue. have %q, want %q", i, issues[i].String(), e)
+		}
+	}
+}
+
+func TestLint_claims(t *testing.T) {
+	cfg := config.ServiceConfig{
+		Endpoints: []*config.EndpointConfig{
+			{
+				Endpoint: "/foo",
+				Method:   "GET",
+				ExtraConfig: config.ExtraConfig{
+					internal.Namespace: []interface{}{
+						map[string]interface{}{"check_expr": "'admin' in apikey.roles"},
+						map[string]interface{}{"check_expr": "cert.cn == 'client'", "phase": "claims"},
+					},
+				},
+			},
+		},
+	}
+
+	if issues := (linter{claims: []string{"apikey", "cert"}}).lint(cfg); len(issues) != 0 {
+		t.Errorf("unexpected issues: %v", issues)
+	}
+
+	if issues := (linter{}).lint(cfg); len(issues) != 2 {
+		t.Errorf("unexpected issues: %v", issues)
+	}
+}
+
+func TestLint_groups(t *testing.T) {
+	cfg := config.ServiceConfig{
+		Endpoints: []*config.EndpointConfig{
+			{
+				Endpoint: "/foo",
+				Method:   "GET",
+				ExtraConfig: config.ExtraConfig{
+					internal.Namespace: map[string]interface{}{
+						"named_rules": map[string]interface{}{
+							"admin":  map[string]interface{}{"check_expr": "JWT.role == 'admin'"},
+							"reader": map[string]interface{}{"check_expr": "req_method == 'GET'"},
+							"loop":   map[string]interface{}{"not": "loop"},
+						},
+						"rules": []interface{}{
+							map[string]interface{}{"name": "ok", "any": []interface{}{"admin", map[string]interface{}{"check_expr": "has(JWT.sub)"}}},
+							map[string]interface{}{"name": "unknown", "all": []interface{}{"admin", "writer"}},
+							map[string]interface{}{"name": "cycle", "not": "loop"},
+							map[string]interface{}{"name": "mixed", "all": []interface{}{"admin", "reader"}},
+							map[string]interface{}{"name": "audit", "any": []interface{}{"reader"}, "mode": "audit"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	expected := []string{
+		`[ENDPOINT: GET /foo] rule "unknown" group: cel: unknown rule "writer"`,
+		`[ENDPOINT: GET /foo] rule "cycle" group: cel: the rule "loop" references itself`,
+		`[ENDPOINT: GET /foo] rule "mixed" group: the variables of the jwt phase are not available in the pre phase`,
+		`[ENDPOINT: GET /foo] rule "mixed" group: the variables of the pre phase are not available in the jwt phase`,
+	}
+
+	issues := linter{}.lint(cfg)
+	if len(issues) != len(expected) {
+		t.Errorf("unexpected issues: %v", issues)
+		return
+	}
+	for i, e := range expected {
+		if issues[i].String() != e {
+			t.Errorf("#%d unexpected issue. have %q, want %q", i, issues[i].String(), e)
+		}
+	}
+}
+
+func TestLint_library(t *testing.T) {
+	cfg := config.ServiceConfig{
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: map[string]interface{}{
+				"constants": map[string]interface{}{"methods": []interface{}{"GET", "HEAD"}},
+				"macros":    map[string]interface{}{"safe_method": "req_method in methods"},
+			},
+		},
+		Endpoints: []*config.EndpointConfig{
+			{
+				Endpoint: "/foo",
+				Method:   "GET",
+				ExtraConfig: config.ExtraConfig{
+					internal.Namespace: []interface{}{
+						map[string]interface{}{"check_expr": "safe_method"},
+						map[string]interface{}{"name": "unknown", "check_expr": "unsafe_method"},
+					},
+				},
+			},
+			{
+				Endpoint: "/bar",
+				Method:   "GET",
+				ExtraConfig: config.ExtraConfig{
+					internal.Namespace: map[string]interface{}{
+						"macros": map[string]interface{}{"cycle": "!cycle"},
+						"rules":  []interface{}{map[string]interface{}{"check_expr": "safe_method"}},
+					},
+				},
+			},
+		},
+	}
+
+	expected := []string{
+		`[ENDPOINT: GET /foo] rule "unknown" check_expr: error parsing the expression`,
+		`[ENDPOINT: GET /bar]: cel: the macro "cycle" references itself`,
+	}
+
+	issues := linter{}.lint(cfg)
+	if len(issues) != len(expected) {
+		t.Errorf("unexpected issues: %v", issues)
+		return
+	}
+	for i, e := range expected {
+		if !strings.HasPrefix(issues[i].String(), e) {
+			t.Errorf("#%d unexpected issue. have %q, want %q", i, issues[i].String(), e)
+		}
+	}
+}
+
+func TestLint_files(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "get.cel"), []byte("// only reads\nreq_method == 'GET'\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "wrong.cel"), []byte("req_method =="), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.ServiceConfig{
+		Endpoints: []*config.EndpointConfig{
+			{
+				Endpoint: "/foo",
+				Method:   "GET",
+				ExtraConfig: config.ExtraConfig{
+					internal.Namespace: []interface{}{
+						map[string]interface{}{"check_file": "get.cel"},
+						map[string]interface{}{"name": "wrong", "check_file": "wrong.cel"},
+					},
+				},
+			},
+			{
+				Endpoint: "/bar",
+				Method:   "GET",
+				ExtraConfig: config.ExtraConfig{
+					internal.Namespace: []interface{}{
+						map[string]interface{}{"check_file": "missing.cel"},
+					},
+				},
+			},
+		},
+	}
+
+	expected := []string{
+		`[ENDPOINT: GET /foo] rule "wrong" check_expr: error parsing the expression`,
+		`[ENDPOINT: GET /bar]: open ` + filepath.Join(dir, "missing.cel"),
+	}
+
+	issues := linter{dir: dir}.lint(cfg)
+	if len(issues) != len(expected) {
+		t.Errorf("unexpected issues: %v", issues)
+		return
+	}
+	for i, e := range expected {
+		if !strings.HasPrefix(issues[i].String(), e) {
+			t.Errorf("#%d unexpected issue. have %q, want %q", i, issues[i].String(), e)
+		}
+	}
+}
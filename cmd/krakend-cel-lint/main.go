@@ -0,0 +1,44 @@
+// krakend-cel-lint validates the CEL definitions of a KrakenD configuration file without
+// starting the gateway. It reports parse errors, type errors, unreachable phases and unused
+// definitions and exits with a non-zero status if any issue is found
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/luraproject/lura/v2/config"
+)
+
+func main() {
+	configFile := flag.String("c", "/etc/krakend/configuration.json", "Path to the configuration filename")
+	claims := flag.String("claims", "", "Comma separated list of the variables used by the claims rejecters")
+	costLimit := flag.Uint64("cost-limit", 0, "Default cost limit of the expressions (0 means no limit)")
+	dir := flag.String("dir", "", "Directory of the relative paths of the policy files, as set with WithConfigDir in the gateway (defaults to the directory of the configuration file)")
+	flag.Parse()
+
+	serviceConfig, err := config.NewParser().Parse(*configFile)
+	if err != nil {
+		log.Fatal("ERROR:", err.Error())
+	}
+
+	l := linter{costLimit: *costLimit, dir: *dir}
+	if l.dir == "" {
+		l.dir = filepath.Dir(*configFile)
+	}
+	if *claims != "" {
+		l.claims = strings.Split(*claims, ",")
+	}
+
+	issues := l.lint(serviceConfig)
+	for _, i := range issues {
+		fmt.Printf("%s: %s\n", *configFile, i)
+	}
+	if len(issues) > 0 {
+		os.Exit(1)
+	}
+}
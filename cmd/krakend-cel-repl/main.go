@@ -0,0 +1,29 @@
+// krakend-cel-repl evaluates CEL expressions interactively with the same environment used by
+// the gateway. The variables are populated from a sample document with the format of the
+// fixtures of the policy test suites (see the celtest package), so the rules can be tried
+// against realistic requests, responses and JWT claims before adding them to the config
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+)
+
+func main() {
+	sample := flag.String("f", "", "Path to the sample document with the request, response and JWT claims")
+	reqBody := flag.Bool("req-body", false, "Expose the body of the sample request as req_body, as the req_body option")
+	respBody := flag.Bool("resp-body", false, "Expose the body of the sample response as resp_body, as the resp_body option")
+	flag.Parse()
+
+	r, err := newREPL(os.Stdout, *reqBody, *respBody)
+	if err != nil {
+		log.Fatal("ERROR:", err.Error())
+	}
+	if *sample != "" {
+		if err := r.load(*sample); err != nil {
+			log.Fatal("ERROR:", err.Error())
+		}
+	}
+	r.run(os.Stdin)
+}
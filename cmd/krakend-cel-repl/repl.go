@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/krakend/krakend-cel/v2/celtest"
+	"github.com/krakend/krakend-cel/v2/internal"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const help = `Enter a CEL expression to evaluate it or one of the commands:
+	:load <file>	load the variables from a sample document
+	:vars		list the declared variables and their types
+	:show		print the values of the loaded variables
+	:help		print this help
+	:quit		exit
+`
+
+var jsonValueType = reflect.TypeOf(&structpb.Value{})
+
+// repl evaluates the expressions against the loaded sample. The body flags mirror the req_body
+// and resp_body options of the config, enabling the variables holding the bodies
+type repl struct {
+	env        *cel.Env
+	activation map[string]interface{}
+	reqBody    bool
+	respBody   bool
+	w          io.Writer
+}
+
+func newREPL(w io.Writer, reqBody, respBody bool) (*repl, error) {
+	env, err := internal.DefaultEnv()
+	if err != nil {
+		return nil, err
+	}
+	activation, err := newActivation(celtest.Fixture{}, reqBody, respBody)
+	if err != nil {
+		return nil, err
+	}
+	return &repl{env: env, activation: activation, reqBody: reqBody, respBody: respBody, w: w}, nil
+}
+
+// run reads and handles the lines of the reader until it is consumed or the quit command
+func (r *repl) run(in io.Reader) {
+	fmt.Fprintln(r.w, "krakend-cel REPL. Type :help for the list of commands")
+	s := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(r.w, "cel> ")
+		if !s.Scan() || !r.handle(s.Text()) {
+			fmt.Fprintln(r.w)
+			return
+		}
+	}
+}
+
+// handle processes a line, returning false if the session must end
+func (r *repl) handle(line string) bool {
+	line = strings.TrimSpace(line)
+	cmd, arg, _ := strings.Cut(line, " ")
+	switch cmd {
+	case "":
+	case ":quit", ":q":
+		return false
+	case ":help":
+		fmt.Fprint(r.w, help)
+	case ":load":
+		if err := r.load(strings.TrimSpace(arg)); err != nil {
+			fmt.Fprintln(r.w, "ERROR:", err.Error())
+			return true
+		}
+		fmt.Fprintln(r.w, "loaded", strings.TrimSpace(arg))
+	case ":vars":
+		r.vars()
+	case ":show":
+		r.show()
+	default:
+		r.eval(line)
+	}
+	return true
+}
+
+// load replaces the variables with the content of a JSON sample document
+func (r *repl) load(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var sample celtest.Fixture
+	if err := json.Unmarshal(b, &sample); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	activation, err := newActivation(sample, r.reqBody, r.respBody)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	r.activation = activation
+	return nil
+}
+
+func (r *repl) vars() {
+	vars := r.env.Variables()
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Name() < vars[j].Name() })
+	for _, v := range vars {
+		// the type identifiers (int, string...) are declared as variables too
+		if v.Type().Kind() == types.TypeKind {
+			continue
+		}
+		fmt.Fprintf(r.w, "%s : %s\n", v.Name(), v.Type())
+	}
+}
+
+func (r *repl) show() {
+	names := make([]string, 0, len(r.activation))
+	for k := range r.activation {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		v := r.activation[k]
+		if h, ok := v.(interface{ Value() interface{} }); ok {
+			v = h.Value()
+		}
+		fmt.Fprintf(r.w, "%s = %v\n", k, v)
+	}
+}
+
+// eval checks the expression and prints its value and type, or the issues found with their
+// position in the expression
+func (r *repl) eval(expr string) {
+	ast, iss := r.env.Compile(expr)
+	if iss != nil && iss.Err() != nil {
+		fmt.Fprintln(r.w, iss.String())
+		return
+	}
+	prg, err := r.env.Program(ast)
+	if err != nil {
+		fmt.Fprintln(r.w, "ERROR:", err.Error())
+		return
+	}
+	res, _, err := prg.Eval(r.activation)
+	if err != nil {
+		fmt.Fprintln(r.w, "ERROR:", err.Error())
+		return
+	}
+	// the JSON compatible values are printed as JSON, so the nested values are readable
+	if v, err := res.ConvertToNative(jsonValueType); err == nil {
+		if b, err := json.Marshal(v.(*structpb.Value).AsInterface()); err == nil {
+			fmt.Fprintf(r.w, "%s : %s\n", b, ast.OutputType())
+			return
+		}
+	}
+	fmt.Fprintf(r.w, "%v : %s\n", res.Value(), ast.OutputType())
+}
+
+// newActivation exposes the sample as the variables set by the proxies and the rejecter. As in
+// the gateway, the bodies are only exposed when their flags are enabled
+func newActivation(s celtest.Fixture, reqBody, respBody bool) (map[string]interface{}, error) {
+	now := s.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	req, err := s.ProxyRequest()
+	if err != nil {
+		return nil, err
+	}
+	resp := s.ProxyResponse()
+
+	var body map[string]interface{}
+	if reqBody {
+		// the proxies expose the bodies not containing a JSON object as an empty map
+		if body, _ = s.Body.(map[string]interface{}); body == nil {
+			body = map[string]interface{}{}
+		}
+	}
+	var rawBody []byte
+	if respBody {
+		rawBody = []byte{}
+		if resp.Io != nil {
+			if rawBody, err = io.ReadAll(resp.Io); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	args := internal.NewReqActivation(req, now, body)
+	for k, v := range internal.NewRespActivation(resp, nil, now, rawBody) {
+		args[k] = v
+	}
+	jwt := s.JWT
+	if jwt == nil {
+		jwt = map[string]interface{}{}
+	}
+	args[internal.JwtKey] = jwt
+	return args, nil
+}
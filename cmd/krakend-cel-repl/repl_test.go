@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestREPL(t *testing.T) {
+	sample := filepath.Join(t.TempDir(), "sample.json")
+	if err := os.WriteFile(sample, []byte(`{
+		"method": "POST",
+		"headers": {"X-Forwarded-For": ["10.1.2.3, 1.1.1.1"]},
+		"jwt": {"sub": "alice", "roles": ["admin"]},
+		"response": {"status": 201, "data": {"collection": [1, 2]}},
+		"now": "2025-01-01T00:00:00Z"
+	}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &bytes.Buffer{}
+	r, err := newREPL(w, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.run(strings.NewReader(strings.Join([]string{
+		"req_method",
+		":load " + sample,
+		"req_method",
+		"ip(header(req_headers, 'x-forwarded-for').split(',')[0]).inCidr('10.0.0.0/8')",
+		"{'roles': JWT.roles, 'items': size(resp_collection)}",
+		"now_str",
+		"req_method == 1",
+		"JWT.missing",
+		"req_body",
+		":vars",
+		":quit",
+		"req_path",
+	}, "\n")))
+
+	output := w.String()
+	for _, expected := range []string{
+		`cel> "GET" : string`,
+		`cel> loaded ` + sample,
+		`cel> "POST" : string`,
+		`cel> true : bool`,
+		`cel> {"items":2,"roles":["admin"]} : map(string, dyn)`,
+		`cel> "2025-01-01T00:00:00Z" : string`,
+		"ERROR: <input>:1:12: found no matching overload for '_==_' applied to '(string, int)'\n | req_method == 1\n | ...........^",
+		`ERROR: no such key: missing`,
+		`ERROR: no such attribute(s): req_body`,
+		"req_headers : map(string, list(string))\n",
+		"resp_metadata_status : int\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("%q not found in the output:\n%s", expected, output)
+		}
+	}
+	if strings.Contains(output, "int : type(int)") {
+		t.Errorf("the type identifiers should not be listed:\n%s", output)
+	}
+	if strings.Contains(output, `"/" : string`) {
+		t.Errorf("the session should end after the quit command:\n%s", output)
+	}
+}
+
+func TestREPL_bodies(t *testing.T) {
+	sample := filepath.Join(t.TempDir(), "sample.json")
+	if err := os.WriteFile(sample, []byte(`{
+		"method": "POST",
+		"body": {"id": 42},
+		"response": {"body": "raw content"}
+	}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &bytes.Buffer{}
+	r, err := newREPL(w, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.run(strings.NewReader(strings.Join([]string{
+		"size(req_body)",
+		":load " + sample,
+		"req_body.id",
+		"string(resp_body)",
+	}, "\n")))
+
+	output := w.String()
+	for _, expected := range []string{
+		`cel> 0 : int`,
+		`cel> 42 : dyn`,
+		`cel> "raw content" : string`,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("%q not found in the output:\n%s", expected, output)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// krakend-cel groups the development tools of the CEL module:
+//
+//	krakend-cel test [-v] [-l level] suite.yaml...
+//
+// The test command evaluates the rules of every suite against its request fixtures and exits
+// with a non-zero status if any fixture does not get the expected outcome
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `usage: krakend-cel <command> [arguments]
+
+commands:
+	test	run the fixtures of the policy test suites
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "test":
+		os.Exit(runTest(os.Args[2:], os.Stdout))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/krakend/krakend-cel/v2/celtest"
+	"github.com/luraproject/lura/v2/logging"
+)
+
+// runTest runs the suites given as arguments and returns the exit status: 0 if all the
+// fixtures pass, 1 if any fails and 2 for invalid arguments or suites
+func runTest(args []string, w io.Writer) int {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	verbose := fs.Bool("v", false, "Print the result of every fixture")
+	logLevel := fs.String("l", "CRITICAL", "Logging level of the rule evaluations")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: krakend-cel test [-v] [-l level] suite.yaml...")
+		return 2
+	}
+
+	logger, err := logging.NewLogger(*logLevel, w, "[CELTEST]")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err.Error())
+		return 2
+	}
+
+	status := 0
+	for _, path := range fs.Args() {
+		suite, err := celtest.Load(path)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR\t%s: %s\n", path, err)
+			status = 2
+			continue
+		}
+		results, err := suite.Run(logger)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR\t%s: %s\n", path, err)
+			status = 2
+			continue
+		}
+
+		failed := 0
+		for _, r := range results {
+			if !r.Passed() {
+				failed++
+				fmt.Fprintf(w, "--- FAIL: %s\n", r)
+				continue
+			}
+			if *verbose {
+				fmt.Fprintf(w, "--- PASS: %s\n", r)
+			}
+		}
+		if failed > 0 {
+			fmt.Fprintf(w, "FAIL\t%s\t%d/%d fixtures failed\n", path, failed, len(results))
+			if status == 0 {
+				status = 1
+			}
+			continue
+		}
+		fmt.Fprintf(w, "ok\t%s\t%d fixtures\n", path, len(results))
+	}
+	return status
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunTest(t *testing.T) {
+	dir := t.TempDir()
+	suites := map[string]string{
+		"ok.json": `{
+			"rules": [{"check_expr": "req_method == 'GET'", "status_code": 405}],
+			"fixtures": [
+				{"name": "get", "expect": "allow"},
+				{"name": "post", "method": "POST", "expect": "deny", "status": 405}
+			]
+		}`,
+		"fail.json": `{
+			"rules": [{"check_expr": "req_method == 'GET'"}],
+			"fixtures": [{"name": "post", "method": "POST", "expect": "allow"}]
+		}`,
+		"wrong.json": `{
+			"rules": [{"check_expr": "req_method =="}],
+			"fixtures": [{"name": "get", "expect": "allow"}]
+		}`,
+	}
+	for name, content := range suites {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		args   []string
+		status int
+		output []string
+	}{
+		{
+			args:   []string{"-v", filepath.Join(dir, "ok.json")},
+			output: []string{"--- PASS: get: want allow, got allow", "--- PASS: post", "ok\t" + filepath.Join(dir, "ok.json") + "\t2 fixtures"},
+		},
+		{
+			args:   []string{filepath.Join(dir, "ok.json"), filepath.Join(dir, "fail.json")},
+			status: 1,
+			output: []string{"--- FAIL: post: want allow, got deny", "FAIL\t" + filepath.Join(dir, "fail.json") + "\t1/1 fixtures failed"},
+		},
+		{
+			args:   []string{filepath.Join(dir, "wrong.json"), filepath.Join(dir, "fail.json")},
+			status: 2,
+			output: []string{"ERROR\t" + filepath.Join(dir, "wrong.json")},
+		},
+		{args: []string{}, status: 2},
+	} {
+		w := &bytes.Buffer{}
+		if status := runTest(tc.args, w); status != tc.status {
+			t.Errorf("%v: unexpected status %d. output:\n%s", tc.args, status, w.String())
+		}
+		for _, o := range tc.output {
+			if !strings.Contains(w.String(), o) {
+				t.Errorf("%v: %q not found in the output:\n%s", tc.args, o, w.String())
+			}
+		}
+	}
+}
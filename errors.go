@@ -0,0 +1,86 @@
+package cel
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/krakend/krakend-cel/v2/internal"
+	"github.com/luraproject/lura/v2/transport/http/client"
+)
+
+// RejectionError is the error returned when a request is aborted by a definition declaring a
+// custom status code. It implements the interfaces used by the lura routers to build the
+// error response, so the client receives the configured status code, body and headers
+type RejectionError struct {
+	Code      int
+	Msg       string
+	Enc       string
+	Header    map[string][]string
+	Evaluator string
+	// explanation holds the values of the sub-expressions of the failed check in explain mode
+	explanation []string
+}
+
+// Error returns the error message
+func (r RejectionError) Error() string {
+	return r.Msg
+}
+
+// StatusCode returns the status code to send to the client
+func (r RejectionError) StatusCode() int {
+	return r.Code
+}
+
+// Encoding returns the content type of the error message
+func (r RejectionError) Encoding() string {
+	return r.Enc
+}
+
+// Headers returns the headers to add to the error response
+func (r RejectionError) Headers() map[string][]string {
+	return r.Header
+}
+
+// rejection is the error returned by the definitions without a status code. The routers handle
+// it as any other error, but it keeps the explanation of the failed check in explain mode
+type rejection struct {
+	msg         string
+	evaluator   string
+	explanation []string
+}
+
+func (r rejection) Error() string {
+	return r.msg
+}
+
+func newRejectionError(eval internal.Evaluator, explanation []string) error {
+	def := eval.Definition
+	msg := def.Message
+	if msg == "" {
+		msg = fmt.Sprintf("request aborted by evaluator %s", eval.ID())
+	}
+	if def.StatusCode == 0 {
+		return rejection{msg: msg, evaluator: eval.ID(), explanation: explanation}
+	}
+	return RejectionError{
+		Code:        def.StatusCode,
+		Msg:         msg,
+		Enc:         def.ContentType,
+		Header:      def.Headers,
+		Evaluator:   eval.ID(),
+		explanation: explanation,
+	}
+}
+
+// replaceError builds the error to return after modifying the message or the status code of a
+// failed execution
+func replaceError(err error, msg string, code int) error {
+	if code == 0 {
+		return errors.New(msg)
+	}
+	var enc string
+	if eErr, ok := err.(interface{ Encoding() string }); ok && msg == err.Error() {
+		enc = eErr.Encoding()
+	}
+	return client.HTTPResponseError{Code: code, Msg: msg, Enc: enc}
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	"github.com/gin-gonic/gin"
@@ -41,10 +42,12 @@ func main() {
 		log.Fatal("ERROR:", err.Error())
 	}
 
+	// the policy files and bundles are resolved from the directory of the config, as the linter does
+	celOpts := []cel.Option{cel.WithConfigDir(filepath.Dir(*configFile))}
 	// cel backend proxy wrapper
-	bf := cel.BackendFactory(logger, proxy.CustomHTTPProxyFactory(client.NewHTTPClient))
+	bf := cel.BackendFactory(logger, proxy.CustomHTTPProxyFactory(client.NewHTTPClient), celOpts...)
 	// cel proxy wrapper
-	pf := cel.ProxyFactory(logger, proxy.NewDefaultFactory(bf, logger))
+	pf := cel.ProxyFactory(logger, proxy.NewDefaultFactory(bf, logger), celOpts...)
 
 	routerFactory := krakendgin.NewFactory(krakendgin.Config{
 		Engine:         gin.Default(),
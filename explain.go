@@ -0,0 +1,54 @@
+package cel
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/krakend/krakend-cel/v2/internal"
+	"github.com/luraproject/lura/v2/proxy"
+)
+
+// explain logs the values of the sub-expressions of a failed check at debug level and returns
+// them. There is nothing to explain if the explain mode is disabled or the rule is a group
+func (o observer) explain(kind string, eval internal.Evaluator, det *cel.EvalDetails) []string {
+	lines := eval.Explain(det)
+	if len(lines) > 0 {
+		o.l.Debug(fmt.Sprintf("%s %s %s explanation: %s", o.name, kind, eval.ID(), strings.Join(lines, "; ")))
+	}
+	return lines
+}
+
+// explainError adds the explanation of the rejection to the headers of the error when the
+// explain header is enabled and the request comes from a trusted caller. The rejections of the
+// definitions without a status code are sent with the 500 status code, so they can have headers
+func (o options) explainError(r *proxy.Request, err error) error {
+	if o.explainHeader == "" || o.explainTrusted == nil || !o.explainTrusted(r) {
+		return err
+	}
+	var re RejectionError
+	if !errors.As(err, &re) {
+		var rj rejection
+		if !errors.As(err, &rj) {
+			return err
+		}
+		re = RejectionError{
+			Code:        http.StatusInternalServerError,
+			Msg:         rj.msg,
+			Evaluator:   rj.evaluator,
+			explanation: rj.explanation,
+		}
+	}
+	if len(re.explanation) == 0 {
+		return err
+	}
+	h := make(map[string][]string, len(re.Header)+1)
+	for k, v := range re.Header {
+		h[k] = v
+	}
+	h[o.explainHeader] = []string{strings.Join(re.explanation, "; ")}
+	re.Header = h
+	return re
+}
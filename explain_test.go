@@ -0,0 +1,166 @@
+package cel
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/krakend/krakend-cel/v2/internal"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/logging"
+	"github.com/luraproject/lura/v2/proxy"
+)
+
+func TestProxyFactory_explain(t *testing.T) {
+	buff := bytes.NewBuffer(make([]byte, 1024))
+	logger, err := logging.NewLogger("DEBUG", buff, "pref")
+	if err != nil {
+		t.Error("building the logger:", err.Error())
+		return
+	}
+
+	trusted := func(r *proxy.Request) bool {
+		return len(r.Headers["X-Trusted"]) > 0
+	}
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return proxy.NoopProxy, nil
+	})
+	prxy, err := ProxyFactory(logger, pf, WithStrictMode(true), WithExplain("X-Cel-Explain", trusted)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{
+					Name:            "role",
+					CheckExpression: "req_method == 'GET' || req_headers['X-Role'][0] == 'admin'",
+					StatusCode:      403,
+					Headers:         map[string][]string{"X-Foo": {"bar"}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `req_method == "GET" || req_headers["X-Role"][0] == "admin" = false; ` +
+		`req_method == "GET" = false; req_headers["X-Role"][0] == "admin" = false; req_headers["X-Role"][0] = "user"; ` +
+		`req_headers["X-Role"] = [user]`
+
+	_, err = prxy(context.Background(), &proxy.Request{Method: "POST", Headers: map[string][]string{
+		"X-Role":    {"user"},
+		"X-Trusted": {"true"},
+	}})
+	re, ok := err.(RejectionError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if h := re.Headers()["X-Cel-Explain"]; len(h) != 1 || h[0] != expected {
+		t.Errorf("unexpected explanation: %v", h)
+	}
+	if h := re.Headers()["X-Foo"]; len(h) != 1 || h[0] != "bar" {
+		t.Errorf("the headers of the rule were not kept: %v", re.Headers())
+	}
+	if !strings.Contains(buff.String(), "Evaluator role explanation: "+expected) {
+		t.Errorf("the explanation was not logged: %s", buff.String())
+	}
+
+	_, err = prxy(context.Background(), &proxy.Request{Method: "POST", Headers: map[string][]string{"X-Role": {"user"}}})
+	if re, ok := err.(RejectionError); !ok || len(re.Headers()["X-Cel-Explain"]) > 0 {
+		t.Errorf("the explanation should not be sent to untrusted callers: %v", err)
+	}
+}
+
+func TestProxyFactory_explainDisabled(t *testing.T) {
+	buff := bytes.NewBuffer(make([]byte, 1024))
+	logger, err := logging.NewLogger("DEBUG", buff, "pref")
+	if err != nil {
+		t.Error("building the logger:", err.Error())
+		return
+	}
+
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return proxy.NoopProxy, nil
+	})
+	prxy, err := ProxyFactory(logger, pf, WithStrictMode(true)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "req_method == 'GET'", StatusCode: 403},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := prxy(context.Background(), &proxy.Request{Method: "POST"}); err == nil {
+		t.Error("expecting error")
+	}
+	if strings.Contains(buff.String(), "explanation") {
+		t.Errorf("unexpected explanation: %s", buff.String())
+	}
+}
+
+func TestNewRejecter_explain(t *testing.T) {
+	buff := bytes.NewBuffer(make([]byte, 1024))
+	logger, err := logging.NewLogger("DEBUG", buff, "pref")
+	if err != nil {
+		t.Error("building the logger:", err.Error())
+		return
+	}
+
+	r := NewRejecter(logger, &config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "JWT.roles.exists(r, r == 'admin')"},
+			},
+		},
+	}, WithExplain("", nil))
+	if !r.Reject(map[string]interface{}{"roles": []interface{}{"user"}}) {
+		t.Fatal("the request should be rejected")
+	}
+	if !strings.Contains(buff.String(), `Rejecter #0 explanation: JWT.roles.exists(r, r == "admin") = false; JWT.roles = [user]`) {
+		t.Errorf("the explanation was not logged: %s", buff.String())
+	}
+}
+
+func TestProxyFactory_explainDefaultRejection(t *testing.T) {
+	trusted := func(r *proxy.Request) bool {
+		return len(r.Headers["X-Trusted"]) > 0
+	}
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return proxy.NoopProxy, nil
+	})
+	prxy, err := ProxyFactory(logging.NoOp, pf, WithStrictMode(true), WithExplain("X-Cel-Explain", trusted)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "req_method == 'GET'"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = prxy(context.Background(), &proxy.Request{Method: "POST", Headers: map[string][]string{"X-Trusted": {"true"}}})
+	re, ok := err.(RejectionError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if re.StatusCode() != 500 || re.Error() != "request aborted by evaluator #0" {
+		t.Errorf("unexpected rejection: %d %s", re.StatusCode(), re.Error())
+	}
+	if h := re.Headers()["X-Cel-Explain"]; len(h) != 1 || h[0] != `req_method == "GET" = false` {
+		t.Errorf("unexpected explanation: %v", h)
+	}
+
+	_, err = prxy(context.Background(), &proxy.Request{Method: "POST", Headers: map[string][]string{}})
+	if err == nil || err.Error() != "request aborted by evaluator #0" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := err.(RejectionError); ok {
+		t.Errorf("the untrusted callers should get the default rejection: %v", err)
+	}
+}
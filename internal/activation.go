@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/transport/http/client"
+)
+
+// NewReqActivation returns the variables of the pre phase for the request. The body is only
+// exposed when it is not nil, as the gateway only reads it if the req_body flag is enabled
+func NewReqActivation(r *proxy.Request, now time.Time, body map[string]interface{}) map[string]interface{} {
+	args := map[string]interface{}{
+		PreKey + "_method":      r.Method,
+		PreKey + "_path":        r.Path,
+		PreKey + "_params":      r.Params,
+		PreKey + "_headers":     NewHeaderMap(r.Headers),
+		PreKey + "_querystring": r.Query,
+		NowKey:                  now,
+		NowStrKey:               FormatNow(now),
+	}
+	if body != nil {
+		args[PreKey+"_body"] = body
+	}
+	return args
+}
+
+// NewRespActivation returns the variables of the post phase for the response and the error of
+// the execution. The body is only exposed when it is not nil, as the gateway only reads it if
+// the resp_body flag is enabled
+func NewRespActivation(r *proxy.Response, err error, now time.Time, body []byte) map[string]interface{} {
+	if r == nil {
+		r = &proxy.Response{}
+	}
+	args := map[string]interface{}{
+		PostKey + "_completed":        r.IsComplete,
+		PostKey + "_metadata_status":  r.Metadata.StatusCode,
+		PostKey + "_metadata_headers": NewHeaderMap(r.Metadata.Headers),
+		PostKey + "_data":             r.Data,
+		PostKey + "_collection":       collection(r.Data),
+		PostKey + "_error":            "",
+		PostKey + "_error_status":     0,
+		PostKey + "_error_body":       "",
+		NowKey:                        now,
+		NowStrKey:                     FormatNow(now),
+	}
+	if err != nil {
+		args[PostKey+"_error"] = err.Error()
+		args[PostKey+"_error_status"] = ErrorStatusCode(err)
+		args[PostKey+"_error_body"] = errorBody(err)
+	}
+	if body != nil {
+		args[PostKey+"_body"] = body
+	}
+	return args
+}
+
+// FormatNow returns the string representation of the time exposed as now_str
+func FormatNow(now time.Time) string {
+	return now.Format("2006-01-02T15:04:05.999Z07:00")
+}
+
+// ErrorStatusCode returns the status code of the errors exposing one, as the ones returned by
+// the lura http clients, or 0 for the rest
+func ErrorStatusCode(err error) int {
+	var sErr interface{ StatusCode() int }
+	if errors.As(err, &sErr) {
+		return sErr.StatusCode()
+	}
+	return 0
+}
+
+// errorBody returns the body of the backend response contained in the lura http errors
+func errorBody(err error) string {
+	var hErr client.HTTPResponseError
+	if errors.As(err, &hErr) {
+		return hErr.Msg
+	}
+	var nErr client.NamedHTTPResponseError
+	if errors.As(err, &nErr) {
+		return nErr.Msg
+	}
+	return ""
+}
+
+// collection returns the top-level list wrapped by the collection backends, or an empty list
+// if the response data is not a collection
+func collection(data map[string]interface{}) interface{} {
+	switch v := data[CollectionKey].(type) {
+	case []interface{}:
+		return v
+	case nil:
+		return []interface{}{}
+	default:
+		if reflect.TypeOf(v).Kind() == reflect.Slice {
+			return v
+		}
+	}
+	return []interface{}{}
+}
@@ -9,31 +9,195 @@ import (
 
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/checker/decls"
+	celast "github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/types"
 	"github.com/luraproject/lura/v2/config"
 	"github.com/luraproject/lura/v2/logging"
 )
 
 type InterpretableDefinition struct {
-	CheckExpression string `json:"check_expr"`
-	ModExpression   string `json:"mod_expr"`
+	Name            string              `json:"name"`
+	CheckExpression string              `json:"check_expr"`
+	ModExpression   string              `json:"mod_expr"`
+	StatusCode      int                 `json:"status_code"`
+	Message         string              `json:"message"`
+	ContentType     string              `json:"content_type"`
+	Headers         map[string][]string `json:"headers"`
+	Phase           Phases              `json:"phase"`
+	// OnError enables the evaluation of the post phase definition when the execution fails
+	OnError bool `json:"on_error"`
+	// CostLimit overrides the cost limit of the parser for this definition
+	CostLimit uint64 `json:"cost_limit"`
+	// Mode is the enforcement mode of the check_expr. In audit mode, the failed checks are
+	// logged and measured but the request is not rejected
+	Mode string `json:"mode"`
+	// Any, All and Not compose the check of the definition from other rules, declared inline
+	// or referenced by their name in the named rules of the config, instead of a check_expr
+	Any []Condition `json:"any"`
+	All []Condition `json:"all"`
+	Not *Condition  `json:"not"`
+	// CheckFile and ModFile are the paths of the files containing the check_expr and mod_expr.
+	// They are loaded by Config.Resolve
+	CheckFile string `json:"check_file"`
+	ModFile   string `json:"mod_file"`
 }
 
-func ConfigGetter(e config.ExtraConfig) ([]InterpretableDefinition, bool) {
-	var def []InterpretableDefinition
+const (
+	EnforceMode = "enforce"
+	AuditMode   = "audit"
+)
+
+// HasValidStatusCode returns true if the definition declares no status code or one the HTTP
+// servers can send, in the 100-599 range
+func (d InterpretableDefinition) HasValidStatusCode() bool {
+	return d.StatusCode == 0 || (d.StatusCode >= 100 && d.StatusCode <= 599)
+}
+
+// IsAudit returns true if the failed checks of the definition must not reject the request
+func (d InterpretableDefinition) IsAudit() bool {
+	return d.Mode == AuditMode
+}
+
+// Phases is the list of phases where a definition must be evaluated. It can be declared
+// as a single string or as a list of strings
+type Phases []string
+
+func (p *Phases) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*p = nil
+		if single != "" {
+			*p = Phases{single}
+		}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*p = list
+	return nil
+}
+
+// Contains returns true if the phase is in the list
+func (p Phases) Contains(phase string) bool {
+	for _, v := range p {
+		if v == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluator is a compiled program along with the definition it was built from
+type Evaluator struct {
+	cel.Program
+	Definition InterpretableDefinition
+	// Index is the position of the definition in the original list
+	Index int
+	// ast is the checked expression, used to explain the evaluations. Groups have none
+	ast *cel.Ast
+	// variables are the ones referenced by the members of a group
+	variables []string
+}
+
+// ID returns the name of the definition or, if it is not named, its position in the
+// original list of definitions, so it does not change when other definitions are skipped
+func (e Evaluator) ID() string {
+	if e.Definition.Name != "" {
+		return e.Definition.Name
+	}
+	return fmt.Sprintf("#%d", e.Index)
+}
+
+// References returns true if the expression, or any member of the group, references the
+// variable
+func (e Evaluator) References(name string) bool {
+	if e.ast == nil {
+		return contains(e.variables, name)
+	}
+	return contains(referencedVariables(e.ast), name)
+}
+
+// UpdatedKeys returns the keys of the map literals of a modifier, as the variables it updates
+// when they are not computed at runtime
+func (e Evaluator) UpdatedKeys() []string {
+	if e.ast == nil {
+		return nil
+	}
+	return updatedKeys(e.ast)
+}
+
+// Config is the module configuration of an endpoint or a backend. It can be declared as a
+// list of definitions or as an object containing the definitions and the module options
+type Config struct {
+	// Strict overrides the default validation mode when set
+	Strict *bool `json:"strict"`
+	// ReqBody enables the req_body variable, exposing the request body decoded as JSON
+	ReqBody bool `json:"req_body"`
+	// RespBody enables the resp_body variable, exposing the raw content of the streamed
+	// responses (the ones without a decoded payload)
+	RespBody bool `json:"resp_body"`
+	// MaxBodySize is the max number of bytes to read from a body. Defaults to DefaultMaxBodySize.
+	// Bigger request bodies abort the request, while only the first bytes of the response
+	// bodies are exposed
+	MaxBodySize int64                     `json:"max_body_size"`
+	Definitions []InterpretableDefinition `json:"rules"`
+	// NamedRules are the rules available to the groups of the definitions. They are not
+	// evaluated on their own
+	NamedRules map[string]InterpretableDefinition `json:"named_rules"`
+	// Constants are values available to the expressions by their name
+	Constants map[string]interface{} `json:"constants"`
+	// Macros are expressions available to other expressions by their name. They can reference
+	// the constants and other macros
+	Macros map[string]string `json:"macros"`
+	// Bundles are the paths of the YAML or JSON policy bundles declaring rules, named rules,
+	// macros and constants. They are loaded by Resolve
+	Bundles []string `json:"bundles"`
+}
+
+// BodySizeLimit returns the max number of bytes to read from a body
+func (c Config) BodySizeLimit() int64 {
+	if c.MaxBodySize <= 0 {
+		return DefaultMaxBodySize
+	}
+	return c.MaxBodySize
+}
+
+// DefaultMaxBodySize is the default max number of bytes to read from a body
+const DefaultMaxBodySize int64 = 1 << 20
+
+// IsStrict returns the validation mode of the config, using the default one if not declared
+func (c Config) IsStrict(defaultValue bool) bool {
+	if c.Strict == nil {
+		return defaultValue
+	}
+	return *c.Strict
+}
+
+func ConfigGetter(e config.ExtraConfig) (Config, bool) {
+	var cfg Config
 
 	v, ok := e[Namespace]
 	if !ok {
-		return def, ok
+		return cfg, ok
 	}
 	buf := new(bytes.Buffer)
 	if err := json.NewEncoder(buf).Encode(&v); err != nil {
-		return def, false
+		return cfg, false
 	}
 
-	if err := json.NewDecoder(buf).Decode(&def); err != nil {
-		return def, false
+	if bytes.HasPrefix(buf.Bytes(), []byte("[")) {
+		if err := json.NewDecoder(buf).Decode(&cfg.Definitions); err != nil {
+			return cfg, false
+		}
+		return cfg, true
 	}
-	return def, true
+
+	if err := json.NewDecoder(buf).Decode(&cfg); err != nil {
+		return cfg, false
+	}
+	return cfg, true
 }
 
 const Namespace = "github.com/devopsfaith/krakend-cel"
@@ -42,8 +206,34 @@ var (
 	ErrParsing  = errors.New("cel: error parsing the expression")
 	ErrChecking = errors.New("cel: error checking the expression and its param definition")
 	ErrNoExpr   = errors.New("cel: no expression")
+	ErrNoPhase  = errors.New("cel: unable to infer the phase of the expression, declare it in the phase field")
+	// ErrMixedPhases is returned by the modifiers updating the variables of a phase other than
+	// the one of the variables they read
+	ErrMixedPhases = errors.New("cel: the modifier updates the variables of a phase other than the one it reads")
 )
 
+// ErrUnknownPhase is returned when a definition declares a phase not supported
+type ErrUnknownPhase string
+
+func (e ErrUnknownPhase) Error() string {
+	return fmt.Sprintf("cel: unknown phase %q", string(e))
+}
+
+// ErrInvalidStatusCode is returned when a definition declares a status code out of the
+// 100-599 range
+type ErrInvalidStatusCode int
+
+func (e ErrInvalidStatusCode) Error() string {
+	return fmt.Sprintf("cel: invalid status code %d", int(e))
+}
+
+// ErrUnknownMode is returned when a definition declares a mode not supported
+type ErrUnknownMode string
+
+func (e ErrUnknownMode) Error() string {
+	return fmt.Sprintf("cel: unknown mode %q", string(e))
+}
+
 type ErrorChecking struct {
 	details error
 }
@@ -54,8 +244,9 @@ func (e ErrorChecking) Error() string {
 
 func NewCheckExpressionParser(l logging.Logger) Parser {
 	return Parser{
-		extractor: extractCheckExpr,
-		l:         l,
+		extractor:  extractCheckExpr,
+		l:          l,
+		composable: true,
 	}
 }
 
@@ -63,84 +254,392 @@ func NewModExpressionParser(l logging.Logger) Parser {
 	return Parser{
 		extractor: extractModExpr,
 		l:         l,
+		modifier:  true,
 	}
 }
 
 type Parser struct {
 	extractor func(InterpretableDefinition) string
 	l         logging.Logger
+	strict    bool
+	claims    string
+	// claimsVars are the variables of all the claims rejecters of the gateway
+	claimsVars []string
+	costLimit  uint64
+	// modifier parsers also infer the phases from the keys of the maps they return
+	modifier bool
+	// composable parsers accept the definitions grouping other rules
+	composable bool
+	namedRules map[string]InterpretableDefinition
+	library    *Library
+	explain    bool
+}
+
+// WithStrict returns a copy of the parser where the expressions failing the type check are
+// reported as errors instead of being skipped
+func (p Parser) WithStrict(strict bool) Parser {
+	p.strict = strict
+	return p
+}
+
+// WithClaims returns a copy of the parser declaring a claims variable with the given name, so
+// the definitions referencing it can be selected with ParseClaims
+func (p Parser) WithClaims(name string) Parser {
+	p.claims = name
+	return p
+}
+
+// WithClaimsVariables returns a copy of the parser declaring the variables of the claims
+// rejecters, so the definitions referencing them are checked and assigned to the claims phase.
+// For the parsers declaring a claims variable with WithClaims, the definitions referencing the
+// rest of variables are assigned to the phase of their own rejecter and never selected
+func (p Parser) WithClaimsVariables(names ...string) Parser {
+	p.claimsVars = names
+	return p
+}
+
+// WithCostLimit returns a copy of the parser limiting the cost of the expressions of the
+// definitions not declaring their own limit. Zero means no limit
+func (p Parser) WithCostLimit(limit uint64) Parser {
+	p.costLimit = limit
+	return p
+}
+
+// WithNamedRules returns a copy of the parser resolving the references of the groups of rules
+// with the given named rules
+func (p Parser) WithNamedRules(rules map[string]InterpretableDefinition) Parser {
+	p.namedRules = rules
+	return p
+}
+
+// WithLibrary returns a copy of the parser where the expressions can reference the constants
+// and macros of the library and the groups can reference its named rules
+func (p Parser) WithLibrary(l *Library) Parser {
+	p.library = l
+	if l != nil {
+		p.namedRules = l.NamedRules
+	}
+	return p
+}
+
+// WithExplain returns a copy of the parser tracking the values of the sub-expressions during
+// the evaluations, so the results can be explained with Evaluator.Explain
+func (p Parser) WithExplain(explain bool) Parser {
+	p.explain = explain
+	return p
 }
 
 func (p Parser) Parse(definition InterpretableDefinition) (cel.Program, error) {
+	e, err := p.compile(definition)
+	return e.prg, err
+}
+
+// Compile parses and checks the expression of the definition
+func (p Parser) Compile(definition InterpretableDefinition) (*cel.Ast, error) {
+	e, err := p.compile(definition)
+	return e.ast, err
+}
+
+func (p Parser) compile(definition InterpretableDefinition) (compiledExpression, error) {
 	expr := p.extractor(definition)
 	if expr == "" {
-		return nil, ErrNoExpr
+		return compiledExpression{}, ErrNoExpr
 	}
 	p.l.Debug("[CEL]", fmt.Sprintf("Parsing expression: %v", expr))
-	env, err := cel.NewEnv(defaultDeclarations())
+	costLimit := p.costLimit
+	if definition.CostLimit > 0 {
+		costLimit = definition.CostLimit
+	}
+	env, envKey, err := p.env()
 	if err != nil {
-		return nil, err
+		return compiledExpression{}, err
 	}
+	return programs.get(env, envKey, expr, costLimit, p.library, p.explain)
+}
 
-	ast, iss := env.Parse(p.extractor(definition))
-	if iss != nil && iss.Err() != nil {
-		return nil, fmt.Errorf("error parsing the expression %s", iss.Err())
+// env returns the environment of the parser and its key in the program cache
+func (p Parser) env() (*cel.Env, string, error) {
+	env, err := DefaultEnv()
+	envKey := defaultEnvKey
+	if names := claimsNames(append([]string{p.claims}, p.claimsVars...)); len(names) > 0 {
+		env, err = ClaimsEnv(names...)
+		envKey = "claims:" + strings.Join(names, ",")
 	}
-	c, iss := env.Check(ast)
-	if iss != nil && iss.Err() != nil {
-		return nil, ErrorChecking{details: iss.Err()}
+	if err != nil || p.library == nil {
+		return env, envKey, err
 	}
+	env, err = p.library.Env(env)
+	return env, envKey + ":" + p.library.key(), err
+}
 
-	return env.Program(c)
+func (p Parser) ParsePre(definitions []InterpretableDefinition) ([]Evaluator, error) {
+	return p.parseByPhase(definitions, PrePhase)
 }
 
-func (p Parser) ParsePre(definitions []InterpretableDefinition) ([]cel.Program, error) {
-	return p.parseByKey(definitions, PreKey)
+func (p Parser) ParsePost(definitions []InterpretableDefinition) ([]Evaluator, error) {
+	return p.parseByPhase(definitions, PostPhase)
 }
 
-func (p Parser) ParsePost(definitions []InterpretableDefinition) ([]cel.Program, error) {
-	return p.parseByKey(definitions, PostKey)
+func (p Parser) ParseJWT(definitions []InterpretableDefinition) ([]Evaluator, error) {
+	return p.parseByPhase(definitions, JwtPhase)
 }
 
-func (p Parser) ParseJWT(definitions []InterpretableDefinition) ([]cel.Program, error) {
-	return p.parseByKey(definitions, JwtKey)
+// ParseClaims returns the evaluators for the claims variable declared with WithClaims. For the
+// JWT variable, it is the same as ParseJWT. For the rest, it selects the definitions declaring
+// the claims phase or referencing the variable
+func (p Parser) ParseClaims(definitions []InterpretableDefinition) ([]Evaluator, error) {
+	if p.claims == "" || p.claims == JwtKey {
+		return p.ParseJWT(definitions)
+	}
+	return p.parseByPhase(definitions, ClaimsPhase)
 }
 
-func (p Parser) parseByKey(definitions []InterpretableDefinition, key string) ([]cel.Program, error) {
-	var res []cel.Program
+// parseByPhase compiles the definitions to evaluate in the given phase. Definitions without an
+// explicit phase are assigned to the phases of the variables referenced by the checked expression
+func (p Parser) parseByPhase(definitions []InterpretableDefinition, phase string) ([]Evaluator, error) {
+	var res []Evaluator
 
-	for _, def := range definitions {
-		if !strings.Contains(p.extractor(def), key) {
+	for i, def := range definitions {
+		for _, ph := range def.Phase {
+			if !knownPhases.Contains(ph) {
+				return res, ErrUnknownPhase(ph)
+			}
+		}
+		if def.Mode != "" && def.Mode != EnforceMode && def.Mode != AuditMode {
+			return res, ErrUnknownMode(def.Mode)
+		}
+		if !def.HasValidStatusCode() {
+			return res, ErrInvalidStatusCode(def.StatusCode)
+		}
+		isGroup := p.composable && def.IsGroup()
+		if (p.extractor(def) == "" && !isGroup) || (len(def.Phase) > 0 && !def.Phase.Contains(phase)) {
 			continue
 		}
-		v, err := p.Parse(def)
-		if _, ok := err.(ErrorChecking); ok {
+
+		var e compiledExpression
+		var err error
+		if isGroup {
+			e, err = p.compileGroup(def, map[string]bool{})
+		} else {
+			e, err = p.compile(def)
+		}
+		if _, ok := err.(ErrorChecking); ok && !p.strict {
 			p.l.Debug("[CEL]", err.Error())
 			continue
 		}
-
 		if err != nil {
 			return res, err
 		}
-		res = append(res, v)
+
+		eval := Evaluator{Program: e.prg, Definition: def, Index: i, ast: e.ast, variables: e.variables}
+		if !e.group {
+			if err := p.CheckPhases(e.ast); err != nil {
+				if p.strict {
+					return res, fmt.Errorf("rule %s: %w", eval.ID(), err)
+				}
+				p.l.Warning("[CEL]", fmt.Sprintf("Skipping the rule %s: %s", eval.ID(), err.Error()))
+				continue
+			}
+		}
+		if len(def.Phase) == 0 {
+			phases := p.inferPhases(e)
+			if len(phases) == 0 {
+				if p.strict {
+					return res, fmt.Errorf("rule %s: %w", eval.ID(), ErrNoPhase)
+				}
+				p.l.Warning("[CEL]", fmt.Sprintf("Skipping the rule %s: %s", eval.ID(), ErrNoPhase.Error()))
+				continue
+			}
+			if !phases.Contains(phase) {
+				continue
+			}
+		}
+		res = append(res, eval)
 	}
 	return res, nil
 }
 
+// inferPhases returns the phases of the variables referenced by a compiled expression or group
+func (p Parser) inferPhases(e compiledExpression) Phases {
+	if e.group {
+		return e.phases
+	}
+	return p.InferPhases(e.ast)
+}
+
+// InferPhases returns the phases of the variables referenced by a checked expression, including
+// the claims phase if it references the claims variable of the parser or, for the parsers not
+// declaring one, any of the claims variables. For the modifiers not referencing any variable,
+// it returns the phases of the variables updated by the maps of the expression
+func (p Parser) InferPhases(ast *cel.Ast) Phases {
+	res := InferPhases(ast)
+	isClaims := p.claims != "" && p.claims != JwtKey
+	for _, ref := range ast.NativeRep().ReferenceMap() {
+		switch {
+		case ref.Name == JwtKey || ref.Name == "":
+		case isClaims && ref.Name == p.claims:
+			res = mergePhases(res, Phases{ClaimsPhase})
+		case contains(p.claimsVars, ref.Name):
+			if isClaims || p.claims == JwtKey {
+				// the variable belongs to another rejecter
+				res = mergePhases(res, Phases{otherClaimsPhase(ref.Name)})
+			} else {
+				res = mergePhases(res, Phases{ClaimsPhase})
+			}
+		}
+	}
+	if p.modifier && len(res) == 0 {
+		return inferModPhases(ast)
+	}
+	return res
+}
+
+// CheckPhases returns ErrMixedPhases for the modifiers reading the variables of a phase and
+// updating the ones of another, as the variables they read are not available when the updates
+// are applied
+func (p Parser) CheckPhases(ast *cel.Ast) error {
+	if !p.modifier {
+		return nil
+	}
+	read := InferPhases(ast)
+	if len(read) == 0 {
+		return nil
+	}
+	for _, phase := range inferModPhases(ast) {
+		if !read.Contains(phase) {
+			return fmt.Errorf("%w: reads %s, updates %s", ErrMixedPhases, strings.Join(read, ","), phase)
+		}
+	}
+	return nil
+}
+
+// knownPhases are the phases that can be declared in the config
+var knownPhases = Phases{PrePhase, PostPhase, JwtPhase, ClaimsPhase}
+
+// otherClaimsPhase is the phase of the definitions referencing the variable of another claims
+// rejecter. It can not be declared in the config
+func otherClaimsPhase(name string) string {
+	return ClaimsPhase + ":" + name
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// InferPhases returns the phases of the variables referenced by a checked expression
+func InferPhases(ast *cel.Ast) Phases {
+	found := map[string]bool{}
+	for _, ref := range ast.NativeRep().ReferenceMap() {
+		switch {
+		case strings.HasPrefix(ref.Name, PreKey+"_"):
+			found[PrePhase] = true
+		case strings.HasPrefix(ref.Name, PostKey+"_"):
+			found[PostPhase] = true
+		case ref.Name == JwtKey:
+			found[JwtPhase] = true
+		}
+	}
+
+	var res Phases
+	for _, phase := range []string{PrePhase, PostPhase, JwtPhase} {
+		if found[phase] {
+			res = append(res, phase)
+		}
+	}
+	return res
+}
+
+// referencedVariables returns the names of the variables referenced by a checked expression
+func referencedVariables(ast *cel.Ast) []string {
+	var res []string
+	for _, ref := range ast.NativeRep().ReferenceMap() {
+		if ref.Name != "" && !contains(res, ref.Name) {
+			res = append(res, ref.Name)
+		}
+	}
+	return res
+}
+
+// inferModPhases returns the phases of the variables used as keys of the map literals of a
+// checked expression, so the modifiers writing static values are assigned to their phase
+func inferModPhases(ast *cel.Ast) Phases {
+	found := map[string]bool{}
+	for _, key := range updatedKeys(ast) {
+		switch {
+		case strings.HasPrefix(key, PreKey+"_"):
+			found[PrePhase] = true
+		case strings.HasPrefix(key, PostKey+"_"):
+			found[PostPhase] = true
+		}
+	}
+
+	var res Phases
+	for _, phase := range []string{PrePhase, PostPhase} {
+		if found[phase] {
+			res = append(res, phase)
+		}
+	}
+	return res
+}
+
+// updatedKeys returns the string literals used as keys of the map literals of a checked
+// expression, in order of appearance
+func updatedKeys(ast *cel.Ast) []string {
+	var res []string
+	celast.PreOrderVisit(ast.NativeRep().Expr(), celast.NewExprVisitor(func(e celast.Expr) {
+		if e.Kind() != celast.MapKind {
+			return
+		}
+		for _, entry := range e.AsMap().Entries() {
+			key := entry.AsMapEntry().Key()
+			if key.Kind() != celast.LiteralKind {
+				continue
+			}
+			if s, ok := key.AsLiteral().(types.String); ok && !contains(res, string(s)) {
+				res = append(res, string(s))
+			}
+		}
+	}))
+	return res
+}
+
+// mergePhases returns the phases of a followed by the ones of b not present in a
+func mergePhases(a, b Phases) Phases {
+	res := append(Phases{}, a...)
+	for _, phase := range b {
+		if !res.Contains(phase) {
+			res = append(res, phase)
+		}
+	}
+	return res
+}
+
 func defaultDeclarations() cel.EnvOption {
 	return cel.Declarations(
-		decls.NewConst(NowKey, decls.String, nil),
+		decls.NewConst(NowKey, decls.Timestamp, nil),
+		decls.NewConst(NowStrKey, decls.String, nil),
 
 		decls.NewConst(PreKey+"_method", decls.String, nil),
 		decls.NewConst(PreKey+"_path", decls.String, nil),
 		decls.NewConst(PreKey+"_params", decls.NewMapType(decls.String, decls.String), nil),
 		decls.NewConst(PreKey+"_headers", decls.NewMapType(decls.String, decls.NewListType(decls.String)), nil),
 		decls.NewConst(PreKey+"_querystring", decls.NewMapType(decls.String, decls.NewListType(decls.String)), nil),
+		decls.NewConst(PreKey+"_body", decls.NewMapType(decls.String, decls.Dyn), nil),
 
 		decls.NewConst(PostKey+"_completed", decls.Bool, nil),
 		decls.NewConst(PostKey+"_metadata_status", decls.Int, nil),
 		decls.NewConst(PostKey+"_metadata_headers", decls.NewMapType(decls.String, decls.NewListType(decls.String)), nil),
 		decls.NewConst(PostKey+"_data", decls.NewMapType(decls.String, decls.Dyn), nil),
+		decls.NewConst(PostKey+"_collection", decls.NewListType(decls.Dyn), nil),
+		decls.NewConst(PostKey+"_body", decls.Bytes, nil),
+		decls.NewConst(PostKey+"_error", decls.String, nil),
+		decls.NewConst(PostKey+"_error_status", decls.Int, nil),
+		decls.NewConst(PostKey+"_error_body", decls.String, nil),
 
 		decls.NewConst(JwtKey, decls.NewMapType(decls.String, decls.Dyn), nil),
 	)
@@ -149,9 +648,22 @@ func defaultDeclarations() cel.EnvOption {
 func extractCheckExpr(i InterpretableDefinition) string { return i.CheckExpression }
 func extractModExpr(i InterpretableDefinition) string   { return i.ModExpression }
 
+// CollectionKey is the key of the response data holding the top-level lists returned by the
+// collection backends
+const CollectionKey = "collection"
+
 const (
 	PreKey  = "req"
 	PostKey = "resp"
 	JwtKey  = "JWT"
 	NowKey  = "now"
+	// NowStrKey exposes the current time as a string, as the now variable used to do
+	NowStrKey = "now_str"
+
+	PrePhase  = "pre"
+	PostPhase = "post"
+	JwtPhase  = "jwt"
+	// ClaimsPhase selects the definitions evaluated by the rejecters of claims sources other
+	// than the JWT
+	ClaimsPhase = "claims"
 )
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/checker"
+)
+
+// DefaultSizeEstimate is the max number of elements (entries, items or characters) assumed for
+// the variables and their fields when estimating the worst-case cost of an expression
+const DefaultSizeEstimate uint64 = 1000
+
+// InterruptCheckFrequency is the number of comprehension iterations between checks of the
+// cancellation of the evaluation context
+const InterruptCheckFrequency uint = 100
+
+// ErrCostLimit is returned when the estimated worst-case cost of an expression exceeds the limit
+type ErrCostLimit struct {
+	Estimated uint64
+	Limit     uint64
+}
+
+func (e ErrCostLimit) Error() string {
+	return fmt.Sprintf("cel: the estimated cost of the expression (%d) exceeds the limit (%d)", e.Estimated, e.Limit)
+}
+
+// sizeEstimator bounds the size of the variables of the environment, so expressions iterating
+// over them get a finite worst-case cost
+type sizeEstimator struct {
+	size uint64
+}
+
+func (s sizeEstimator) EstimateSize(element checker.AstNode) *checker.SizeEstimate {
+	if len(element.Path()) == 0 {
+		return nil
+	}
+	return &checker.SizeEstimate{Min: 0, Max: s.size}
+}
+
+func (sizeEstimator) EstimateCallCost(_, _ string, _ *checker.AstNode, _ []checker.AstNode) *checker.CallEstimate {
+	return nil
+}
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+)
+
+// defaultEnvKey identifies the declarations of the shared environment in the program cache
+const defaultEnvKey = "default"
+
+var (
+	envOnce   sync.Once
+	sharedEnv *cel.Env
+	envErr    error
+
+	claimsEnvs   = map[string]*cel.Env{}
+	claimsEnvsMu sync.Mutex
+
+	programs = newProgramCache(ProgramCacheSize)
+)
+
+// DefaultEnv returns the process-wide CEL environment with the default declarations. The
+// environment is built once and it is safe for concurrent use
+func DefaultEnv() (*cel.Env, error) {
+	envOnce.Do(func() {
+		// the macro calls are tracked, so the explanations can print the comprehensions
+		sharedEnv, envErr = cel.NewEnv(defaultDeclarations(), timeFunctions(), gatewayFunctions(), cel.EnableMacroCallTracking())
+	})
+	return sharedEnv, envErr
+}
+
+// ClaimsEnv returns the shared environment extended with the declaration of the claims
+// variables with the given names. The JWT variable is already part of the default declarations
+func ClaimsEnv(names ...string) (*cel.Env, error) {
+	env, err := DefaultEnv()
+	names = claimsNames(names)
+	if err != nil || len(names) == 0 {
+		return env, err
+	}
+
+	key := strings.Join(names, ",")
+	claimsEnvsMu.Lock()
+	defer claimsEnvsMu.Unlock()
+	if e, ok := claimsEnvs[key]; ok {
+		return e, nil
+	}
+	opts := make([]cel.EnvOption, len(names))
+	for i, name := range names {
+		opts[i] = cel.Variable(name, cel.MapType(cel.StringType, cel.DynType))
+	}
+	e, err := env.Extend(opts...)
+	if err != nil {
+		return nil, err
+	}
+	claimsEnvs[key] = e
+	return e, nil
+}
+
+// claimsNames returns the sorted and unique names of the claims variables, without the JWT one
+func claimsNames(names []string) []string {
+	var res []string
+	for _, name := range names {
+		if name == "" || name == JwtKey {
+			continue
+		}
+		if i := sort.SearchStrings(res, name); i == len(res) || res[i] != name {
+			res = append(res[:i], append([]string{name}, res[i:]...)...)
+		}
+	}
+	return res
+}
+
+type compiledExpression struct {
+	ast *cel.Ast
+	prg cel.Program
+	// groups of rules have no AST, so they carry the phases and the variables referenced by
+	// their members
+	group     bool
+	phases    Phases
+	variables []string
+}
+
+// ProgramCacheSize is the max number of compiled expressions kept by the program cache
+const ProgramCacheSize = 1024
+
+// programCache stores the checked and compiled expressions, so identical expressions declared
+// in several endpoints or backends are compiled just once. The least recently used entries are
+// evicted when the cache is full, so the expressions replaced at runtime, and the environments
+// of their libraries, are released once no proxy uses them
+type programCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type programCacheEntry struct {
+	key string
+	e   compiledExpression
+}
+
+func newProgramCache(size int) *programCache {
+	return &programCache{size: size, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (c *programCache) load(key string) (compiledExpression, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return compiledExpression{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*programCacheEntry).e, true
+}
+
+func (c *programCache) store(key string, e compiledExpression) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&programCacheEntry{key: key, e: e})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*programCacheEntry).key)
+	}
+}
+
+// get returns the compiled expression. When costLimit is not zero, the expressions with an
+// estimated worst-case cost over the limit are rejected and the programs abort the evaluations
+// exceeding it. The macros of the library, if any, are inlined into the checked expression.
+// The programs compiled with explain track the values of all the sub-expressions
+func (c *programCache) get(env *cel.Env, envKey, expr string, costLimit uint64, lib *Library, explain bool) (compiledExpression, error) {
+	key := fmt.Sprintf("%s\x00%d\x00%t\x00%s", envKey, costLimit, explain, expr)
+
+	e, ok := c.load(key)
+	if ok {
+		return e, nil
+	}
+
+	ast, iss := env.Parse(expr)
+	if iss != nil && iss.Err() != nil {
+		return e, fmt.Errorf("error parsing the expression %s", iss.Err())
+	}
+	checked, iss := env.Check(ast)
+	if iss != nil && iss.Err() != nil {
+		return e, ErrorChecking{details: iss.Err()}
+	}
+	if lib != nil {
+		var err error
+		if checked, err = lib.inline(env, checked); err != nil {
+			return e, ErrorChecking{details: err}
+		}
+	}
+
+	evalOpts := cel.OptTrackCost
+	if explain {
+		evalOpts |= cel.OptTrackState
+	}
+	opts := []cel.ProgramOption{
+		cel.EvalOptions(evalOpts),
+		cel.InterruptCheckFrequency(InterruptCheckFrequency),
+	}
+	if costLimit > 0 {
+		est, err := env.EstimateCost(checked, sizeEstimator{size: DefaultSizeEstimate})
+		if err != nil {
+			return e, err
+		}
+		if est.Max > costLimit {
+			return e, ErrCostLimit{Estimated: est.Max, Limit: costLimit}
+		}
+		opts = append(opts, cel.CostLimit(costLimit))
+	}
+
+	prg, err := env.Program(checked, opts...)
+	if err != nil {
+		return e, err
+	}
+	e = compiledExpression{ast: checked, prg: prg}
+
+	c.store(key, e)
+	return e, nil
+}
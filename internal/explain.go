@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	celast "github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter"
+)
+
+// MaxExplainedValueSize is the max length of the values reported by Evaluator.Explain. Longer
+// values are truncated
+const MaxExplainedValueSize = 100
+
+// Explain returns the values of the sub-expressions of the last evaluation, from the outermost
+// one, as "expression = value". The variables, the literals and the sub-expressions skipped by
+// the logical operators are not reported, and the comprehensions are reported as a whole, along
+// with their range. It returns nil for the groups, as they have no evaluation details, and for
+// the evaluators not parsed with WithExplain
+func (e Evaluator) Explain(details *cel.EvalDetails) []string {
+	if e.ast == nil || details == nil || details.State() == nil {
+		return nil
+	}
+	native := e.ast.NativeRep()
+	x := explainer{state: details.State(), info: native.SourceInfo()}
+	x.visit(native.Expr())
+	return x.lines
+}
+
+type explainer struct {
+	state interpreter.EvalState
+	info  *celast.SourceInfo
+	lines []string
+}
+
+func (x *explainer) visit(e celast.Expr) {
+	switch e.Kind() {
+	case celast.CallKind:
+		x.add(e)
+		call := e.AsCall()
+		if call.IsMemberFunction() {
+			x.visit(call.Target())
+		}
+		for _, arg := range call.Args() {
+			x.visit(arg)
+		}
+	case celast.SelectKind:
+		x.add(e)
+		x.visit(e.AsSelect().Operand())
+	case celast.ListKind:
+		for _, elem := range e.AsList().Elements() {
+			x.visit(elem)
+		}
+	case celast.MapKind:
+		for _, entry := range e.AsMap().Entries() {
+			x.visit(entry.AsMapEntry().Value())
+		}
+	case celast.ComprehensionKind:
+		// the values of the loop only reflect its last iteration, so only the range is reported
+		x.add(e)
+		x.visit(e.AsComprehension().IterRange())
+	}
+}
+
+func (x *explainer) add(e celast.Expr) {
+	v, ok := x.state.Value(e.ID())
+	if !ok {
+		return
+	}
+	expr, err := cel.ExprToString(e, x.info)
+	if err != nil {
+		return
+	}
+	x.lines = append(x.lines, expr+" = "+formatValue(v))
+}
+
+func formatValue(v ref.Val) string {
+	var s string
+	switch val := v.(type) {
+	case types.String:
+		s = strconv.Quote(string(val))
+	case *types.Err:
+		s = "error: " + val.String()
+	default:
+		s = fmt.Sprintf("%v", v.Value())
+	}
+	// the explanations are logged and sent in headers, so they must fit in a single line
+	s = strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+	if len(s) > MaxExplainedValueSize {
+		s = s[:MaxExplainedValueSize] + "..."
+	}
+	return s
+}
@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrExprAndFile   = errors.New("cel: a definition can not declare an expression and a file for the same field")
+	ErrNestedBundles = errors.New("cel: the policy bundles can not declare other bundles")
+)
+
+// Resolve returns a copy of the config with the external policies loaded. The expressions of
+// the check_file and mod_file fields are read into check_expr and mod_expr, and the rules,
+// named rules, macros and constants of the bundles are merged into the config: the rules of
+// the bundles go before the ones of the config and the named entries of the config override
+// the ones of the bundles. Relative paths are resolved from dir, or from the working directory
+// if it is empty, and the paths found in a bundle from the directory of the bundle
+func (c Config) Resolve(dir string) (Config, error) {
+	if len(c.Bundles) == 0 && !c.hasFiles() {
+		return c, nil
+	}
+
+	res := c
+	res.Bundles = nil
+	res.Definitions = nil
+	res.NamedRules = map[string]InterpretableDefinition{}
+	res.Macros = map[string]string{}
+	res.Constants = map[string]interface{}{}
+
+	for _, path := range c.Bundles {
+		bundle, err := loadBundle(resolvePath(dir, path))
+		if err != nil {
+			return c, err
+		}
+		res.Definitions = append(res.Definitions, bundle.Definitions...)
+		for k, v := range bundle.NamedRules {
+			res.NamedRules[k] = v
+		}
+		for k, v := range bundle.Macros {
+			res.Macros[k] = v
+		}
+		for k, v := range bundle.Constants {
+			res.Constants[k] = v
+		}
+	}
+
+	local, err := c.resolveFiles(dir)
+	if err != nil {
+		return c, err
+	}
+	res.Definitions = append(res.Definitions, local.Definitions...)
+	for k, v := range local.NamedRules {
+		res.NamedRules[k] = v
+	}
+	for k, v := range c.Macros {
+		res.Macros[k] = v
+	}
+	for k, v := range c.Constants {
+		res.Constants[k] = v
+	}
+	return res, nil
+}
+
+// resolveFiles loads the expressions of the definitions and named rules declared in files
+func (c Config) resolveFiles(dir string) (Config, error) {
+	res := c
+	res.Definitions = make([]InterpretableDefinition, len(c.Definitions))
+	for i, def := range c.Definitions {
+		d, err := def.resolve(dir)
+		if err != nil {
+			return c, err
+		}
+		res.Definitions[i] = d
+	}
+	res.NamedRules = make(map[string]InterpretableDefinition, len(c.NamedRules))
+	for k, def := range c.NamedRules {
+		d, err := def.resolve(dir)
+		if err != nil {
+			return c, err
+		}
+		res.NamedRules[k] = d
+	}
+	return res, nil
+}
+
+func (c Config) hasFiles() bool {
+	for _, def := range c.Definitions {
+		if def.hasFiles() {
+			return true
+		}
+	}
+	for _, def := range c.NamedRules {
+		if def.hasFiles() {
+			return true
+		}
+	}
+	return false
+}
+
+func (d InterpretableDefinition) hasFiles() bool {
+	if d.CheckFile != "" || d.ModFile != "" {
+		return true
+	}
+	for _, c := range d.conditions() {
+		if c.Definition != nil && c.Definition.hasFiles() {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve loads the expressions of the definition and its inline conditions declared in files
+func (d InterpretableDefinition) resolve(dir string) (InterpretableDefinition, error) {
+	if d.CheckFile != "" {
+		if d.CheckExpression != "" {
+			return d, ErrExprAndFile
+		}
+		expr, err := readExpression(resolvePath(dir, d.CheckFile))
+		if err != nil {
+			return d, err
+		}
+		d.CheckExpression, d.CheckFile = expr, ""
+	}
+	if d.ModFile != "" {
+		if d.ModExpression != "" {
+			return d, ErrExprAndFile
+		}
+		expr, err := readExpression(resolvePath(dir, d.ModFile))
+		if err != nil {
+			return d, err
+		}
+		d.ModExpression, d.ModFile = expr, ""
+	}
+
+	var err error
+	if d.Any, err = resolveConditions(d.Any, dir); err != nil {
+		return d, err
+	}
+	if d.All, err = resolveConditions(d.All, dir); err != nil {
+		return d, err
+	}
+	if d.Not != nil {
+		not, err := resolveConditions([]Condition{*d.Not}, dir)
+		if err != nil {
+			return d, err
+		}
+		d.Not = &not[0]
+	}
+	return d, nil
+}
+
+// conditions returns the members of the group declared by the definition, if any
+func (d InterpretableDefinition) conditions() []Condition {
+	res := append(append([]Condition{}, d.Any...), d.All...)
+	if d.Not != nil {
+		res = append(res, *d.Not)
+	}
+	return res
+}
+
+func resolveConditions(conditions []Condition, dir string) ([]Condition, error) {
+	if conditions == nil {
+		return nil, nil
+	}
+	res := make([]Condition, len(conditions))
+	for i, c := range conditions {
+		res[i] = c
+		if c.Definition == nil {
+			continue
+		}
+		def, err := c.Definition.resolve(dir)
+		if err != nil {
+			return nil, err
+		}
+		res[i].Definition = &def
+	}
+	return res, nil
+}
+
+// loadBundle reads a YAML or JSON policy bundle, with the same structure as the object form of
+// the config, and loads the files it references
+func loadBundle(path string) (Config, error) {
+	var cfg Config
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	var content interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &content)
+	default:
+		err = json.Unmarshal(b, &content)
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("cel: bundle %s: %w", path, err)
+	}
+
+	// the bundle is decoded through JSON, so it supports the same formats as the extra config
+	b, err = json.Marshal(content)
+	if err != nil {
+		return cfg, fmt.Errorf("cel: bundle %s: %w", path, err)
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("cel: bundle %s: %w", path, err)
+	}
+	if len(cfg.Bundles) > 0 {
+		return cfg, ErrNestedBundles
+	}
+	return cfg.resolveFiles(filepath.Dir(path))
+}
+
+// readExpression reads an expression file. CEL supports line comments (//) and expressions
+// spanning several lines, so the content is used as it is
+func readExpression(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	expr := strings.TrimSpace(string(b))
+	if expr == "" {
+		return "", fmt.Errorf("cel: empty expression file %s", path)
+	}
+	return expr, nil
+}
+
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) || dir == "" {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
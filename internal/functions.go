@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	"github.com/google/cel-go/ext"
+	"github.com/google/cel-go/interpreter"
+)
+
+// gatewayFunctions declares the helpers for the usual gateway checks:
+//
+//	ip('10.1.2.3').inCidr('10.0.0.0/8') // true if the address is in the network
+//	isIP('10.1.2.3') // true if the string is a valid IPv4 or IPv6 address
+//	string(ip('::ffff:10.1.2.3')) // the canonical representation of the address
+//	header(req_headers, 'x-forwarded-for') // the first value of the header, matching its name
+//	                                       // case-insensitively, or an empty string
+//	sha256('foo') // the hex encoded SHA-256 digest of the string
+//	'v1.2.3'.captures('v(\\d+)\\.(\\d+)') // ['1', '2'], the capture groups of the first match,
+//	                                      // or an empty list if there is no match
+//
+// It also includes the base64, regex and strings extensions of cel-go, so the values can be
+// decoded (base64.decode), extracted (regex.extract) or split and trimmed:
+//
+//	ip(header(req_headers, 'X-Forwarded-For').split(',')[0].trim()).inCidr('192.168.0.0/16')
+func gatewayFunctions() cel.EnvOption {
+	return cel.Lib(gatewayLib{})
+}
+
+// IPType is the CEL type of the values returned by the ip function
+var IPType = cel.OpaqueType("net.IP")
+
+type gatewayLib struct{}
+
+func (gatewayLib) CompileOptions() []cel.EnvOption {
+	return []cel.EnvOption{
+		ext.Encoders(),
+		ext.Strings(),
+		cel.OptionalTypes(),
+		ext.Regex(),
+		cel.Function("ip",
+			cel.Overload("ip_string", []*cel.Type{cel.StringType}, IPType,
+				cel.UnaryBinding(parseIP),
+			),
+		),
+		cel.Function("isIP",
+			cel.Overload("is_ip_string", []*cel.Type{cel.StringType}, cel.BoolType,
+				cel.UnaryBinding(isIP),
+			),
+		),
+		cel.Function("inCidr",
+			cel.MemberOverload("ip_in_cidr_string", []*cel.Type{IPType, cel.StringType}, cel.BoolType,
+				cel.BinaryBinding(inCidr),
+			),
+		),
+		cel.Function("string",
+			cel.Overload("ip_to_string", []*cel.Type{IPType}, cel.StringType,
+				cel.UnaryBinding(ipToString),
+			),
+		),
+		cel.Function("header",
+			cel.Overload("header_map_string",
+				[]*cel.Type{cel.MapType(cel.StringType, cel.ListType(cel.StringType)), cel.StringType}, cel.StringType,
+				cel.BinaryBinding(header),
+			),
+		),
+		cel.Function("sha256",
+			cel.Overload("sha256_string", []*cel.Type{cel.StringType}, cel.StringType,
+				cel.UnaryBinding(sha256Hex),
+			),
+		),
+		cel.Function("captures",
+			cel.MemberOverload("string_captures_string", []*cel.Type{cel.StringType, cel.StringType}, cel.ListType(cel.StringType),
+				cel.BinaryBinding(captures),
+			),
+		),
+	}
+}
+
+func (gatewayLib) ProgramOptions() []cel.ProgramOption {
+	return []cel.ProgramOption{
+		cel.OptimizeRegex(capturesOptimization),
+	}
+}
+
+// ipValue is the runtime value of the IPType
+type ipValue struct {
+	netip.Addr
+}
+
+func (v ipValue) ConvertToNative(typeDesc reflect.Type) (any, error) {
+	switch typeDesc {
+	case reflect.TypeOf(netip.Addr{}):
+		return v.Addr, nil
+	case reflect.TypeOf(""):
+		return v.Addr.String(), nil
+	}
+	return nil, fmt.Errorf("type conversion error from IP to %v", typeDesc)
+}
+
+func (v ipValue) ConvertToType(t ref.Type) ref.Val {
+	switch t {
+	case IPType:
+		return v
+	case types.StringType:
+		return types.String(v.Addr.String())
+	case types.TypeType:
+		return IPType
+	}
+	return types.NewErr("type conversion error from IP to %v", t)
+}
+
+func (v ipValue) Equal(other ref.Val) ref.Val {
+	o, ok := other.(ipValue)
+	return types.Bool(ok && o.Addr == v.Addr)
+}
+
+func (ipValue) Type() ref.Type {
+	return IPType
+}
+
+func (v ipValue) Value() any {
+	return v.Addr
+}
+
+func parseIP(v ref.Val) ref.Val {
+	s, ok := v.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(v)
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(string(s)))
+	if err != nil {
+		return types.NewErr("invalid IP address %q", string(s))
+	}
+	return ipValue{addr.Unmap()}
+}
+
+func isIP(v ref.Val) ref.Val {
+	s, ok := v.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(v)
+	}
+	_, err := netip.ParseAddr(strings.TrimSpace(string(s)))
+	return types.Bool(err == nil)
+}
+
+func inCidr(v, cidr ref.Val) ref.Val {
+	addr, ok := v.(ipValue)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(v)
+	}
+	s, ok := cidr.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(cidr)
+	}
+	prefix, err := netip.ParsePrefix(string(s))
+	if err != nil {
+		return types.NewErr("invalid CIDR %q", string(s))
+	}
+	return types.Bool(prefix.Contains(addr.Addr))
+}
+
+func ipToString(v ref.Val) ref.Val {
+	addr, ok := v.(ipValue)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(v)
+	}
+	return types.String(addr.Addr.String())
+}
+
+// header returns the first value of the header, looking up its name case-insensitively
+func header(headers, name ref.Val) ref.Val {
+	m, ok := headers.(traits.Mapper)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(headers)
+	}
+	n, ok := name.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(name)
+	}
+	for it := m.Iterator(); it.HasNext() == types.True; {
+		k := it.Next()
+		if ks, ok := k.(types.String); !ok || !strings.EqualFold(string(ks), string(n)) {
+			continue
+		}
+		values, ok := m.Get(k).(traits.Lister)
+		if !ok || values.Size() == types.IntZero {
+			return types.String("")
+		}
+		return values.Get(types.IntZero)
+	}
+	return types.String("")
+}
+
+func sha256Hex(v ref.Val) ref.Val {
+	s, ok := v.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(v)
+	}
+	sum := sha256.Sum256([]byte(s))
+	return types.String(hex.EncodeToString(sum[:]))
+}
+
+// captures returns the capture groups of the first match of the pattern. The patterns declared
+// as literals are compiled once by capturesOptimization, so only the dynamic ones, usually built
+// from the request, are compiled on every call
+func captures(target, pattern ref.Val) ref.Val {
+	p, ok := pattern.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(pattern)
+	}
+	re, err := regexp.Compile(string(p))
+	if err != nil {
+		return types.NewErr("invalid regex %q: %v", string(p), err)
+	}
+	return capturesRegexp(re, target)
+}
+
+func capturesRegexp(re *regexp.Regexp, target ref.Val) ref.Val {
+	s, ok := target.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(target)
+	}
+	match := re.FindStringSubmatch(string(s))
+	if len(match) == 0 {
+		return types.DefaultTypeAdapter.NativeToValue([]string{})
+	}
+	return types.DefaultTypeAdapter.NativeToValue(match[1:])
+}
+
+// capturesOptimization compiles the literal patterns of the captures calls when building the
+// programs, reporting the invalid ones as errors
+var capturesOptimization = &interpreter.RegexOptimization{
+	Function:   "captures",
+	RegexIndex: 1,
+	Factory: func(call interpreter.InterpretableCall, pattern string) (interpreter.InterpretableCall, error) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return interpreter.NewCall(call.ID(), call.Function(), call.OverloadID(), call.Args(), func(args ...ref.Val) ref.Val {
+			if len(args) != 2 {
+				return types.NoSuchOverloadErr()
+			}
+			return capturesRegexp(re, args[0])
+		}), nil
+	},
+}
@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+const (
+	anyGroup = "any"
+	allGroup = "all"
+	notGroup = "not"
+)
+
+var (
+	ErrGroupExpr      = errors.New("cel: a group of rules can not declare an expression")
+	ErrGroupOperators = errors.New("cel: a group of rules must declare just one of any, all or not")
+	ErrEmptyGroup     = errors.New("cel: empty group of rules")
+)
+
+// ErrUnknownRule is returned when a group references a named rule not declared
+type ErrUnknownRule string
+
+func (e ErrUnknownRule) Error() string {
+	return fmt.Sprintf("cel: unknown rule %q", string(e))
+}
+
+// ErrRuleCycle is returned when a named rule references itself, directly or through other groups
+type ErrRuleCycle string
+
+func (e ErrRuleCycle) Error() string {
+	return fmt.Sprintf("cel: the rule %q references itself", string(e))
+}
+
+// Condition is a member of a group of rules. It is declared as the name of a named rule or as
+// an inline definition, which can be a group itself
+type Condition struct {
+	Ref        string
+	Definition *InterpretableDefinition
+}
+
+func (c *Condition) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*c = Condition{Ref: name}
+		return nil
+	}
+	var def InterpretableDefinition
+	if err := json.Unmarshal(b, &def); err != nil {
+		return err
+	}
+	*c = Condition{Definition: &def}
+	return nil
+}
+
+func (c Condition) MarshalJSON() ([]byte, error) {
+	if c.Definition != nil {
+		return json.Marshal(c.Definition)
+	}
+	return json.Marshal(c.Ref)
+}
+
+// IsGroup returns true if the check of the definition is composed from other rules
+func (d InterpretableDefinition) IsGroup() bool {
+	return d.Any != nil || d.All != nil || d.Not != nil
+}
+
+// operator returns the boolean operator of the group and its members
+func (d InterpretableDefinition) operator() (string, []Condition, error) {
+	var op string
+	var members []Condition
+	declared := 0
+	if d.Any != nil {
+		op, members = anyGroup, d.Any
+		declared++
+	}
+	if d.All != nil {
+		op, members = allGroup, d.All
+		declared++
+	}
+	if d.Not != nil {
+		op, members = notGroup, []Condition{*d.Not}
+		declared++
+	}
+	if declared != 1 {
+		return op, members, ErrGroupOperators
+	}
+	if len(members) == 0 {
+		return op, members, ErrEmptyGroup
+	}
+	return op, members, nil
+}
+
+// CompileGroup parses and checks the rules composing the check of a group, returning the
+// phases of the variables they reference
+func (p Parser) CompileGroup(definition InterpretableDefinition) (Phases, error) {
+	e, err := p.compileGroup(definition, map[string]bool{})
+	return e.phases, err
+}
+
+// compileGroup builds a program evaluating the members of the group with short-circuit. The
+// named rules being resolved are tracked in visiting, so reference cycles are detected
+func (p Parser) compileGroup(definition InterpretableDefinition, visiting map[string]bool) (compiledExpression, error) {
+	if definition.CheckExpression != "" || definition.ModExpression != "" {
+		return compiledExpression{}, ErrGroupExpr
+	}
+	op, conditions, err := definition.operator()
+	if err != nil {
+		return compiledExpression{}, err
+	}
+
+	g := groupProgram{op: op, members: make([]groupMember, len(conditions))}
+	found := map[string]bool{}
+	var others Phases
+	var variables []string
+	for i, c := range conditions {
+		member, err := p.compileCondition(c, i, visiting)
+		if err != nil {
+			return compiledExpression{}, err
+		}
+		g.members[i] = member.groupMember
+		for _, v := range member.variables {
+			if !contains(variables, v) {
+				variables = append(variables, v)
+			}
+		}
+		for _, ph := range member.phases {
+			found[ph] = true
+		}
+		// the phases of the variables of other claims rejecters
+		for _, ph := range member.phases {
+			if !knownPhases.Contains(ph) && !others.Contains(ph) {
+				others = append(others, ph)
+			}
+		}
+	}
+
+	var phases Phases
+	for _, ph := range knownPhases {
+		if found[ph] {
+			phases = append(phases, ph)
+		}
+	}
+	return compiledExpression{prg: g, phases: append(phases, others...), variables: variables, group: true}, nil
+}
+
+type compiledMember struct {
+	groupMember
+	phases    Phases
+	variables []string
+}
+
+func (p Parser) compileCondition(c Condition, i int, visiting map[string]bool) (compiledMember, error) {
+	def := c.Definition
+	id := fmt.Sprintf("#%d", i)
+	if c.Ref != "" {
+		named, ok := p.namedRules[c.Ref]
+		if !ok {
+			return compiledMember{}, ErrUnknownRule(c.Ref)
+		}
+		if visiting[c.Ref] {
+			return compiledMember{}, ErrRuleCycle(c.Ref)
+		}
+		visiting[c.Ref] = true
+		defer delete(visiting, c.Ref)
+		def, id = &named, c.Ref
+	} else if def.Name != "" {
+		id = def.Name
+	}
+
+	if def.IsGroup() {
+		e, err := p.compileGroup(*def, visiting)
+		return compiledMember{groupMember{id: id, prg: e.prg}, e.phases, e.variables}, err
+	}
+
+	e, err := p.compile(*def)
+	if err != nil {
+		return compiledMember{}, err
+	}
+	if kind := e.ast.OutputType().Kind(); kind != types.BoolKind && kind != types.DynKind {
+		return compiledMember{}, fmt.Errorf("cel: the rule %s returns %s instead of bool", id, e.ast.OutputType())
+	}
+	return compiledMember{groupMember{id: id, prg: e.prg}, p.InferPhases(e.ast), referencedVariables(e.ast)}, nil
+}
+
+type groupMember struct {
+	id  string
+	prg cel.Program
+}
+
+// groupProgram evaluates a group of rules in order. As the CEL logical operators, any returns
+// true as soon as a member is true and all returns false as soon as a member is false, while
+// the errors are only returned if no member decides the result
+type groupProgram struct {
+	op      string
+	members []groupMember
+}
+
+func (g groupProgram) Eval(input any) (ref.Val, *cel.EvalDetails, error) {
+	return g.ContextEval(context.Background(), input)
+}
+
+func (g groupProgram) ContextEval(ctx context.Context, input any) (ref.Val, *cel.EvalDetails, error) {
+	if g.op == notGroup {
+		v, err := g.members[0].eval(ctx, input)
+		if err != nil {
+			return types.WrapErr(err), nil, err
+		}
+		return types.Bool(!v), nil, nil
+	}
+
+	decisive := g.op == anyGroup
+	var firstErr error
+	for _, m := range g.members {
+		v, err := m.eval(ctx, input)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if v == decisive {
+			return types.Bool(decisive), nil, nil
+		}
+	}
+	if firstErr != nil {
+		return types.WrapErr(firstErr), nil, firstErr
+	}
+	return types.Bool(!decisive), nil, nil
+}
+
+func (m groupMember) eval(ctx context.Context, input any) (bool, error) {
+	res, _, err := m.prg.ContextEval(ctx, input)
+	if err != nil {
+		return false, fmt.Errorf("rule %s: %w", m.id, err)
+	}
+	v, ok := res.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("rule %s returned %s instead of bool", m.id, res.Type())
+	}
+	return v, nil
+}
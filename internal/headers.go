@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"net/textproto"
+	"strings"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+)
+
+// NewHeaderMap exposes the headers as a CEL map where the names are matched case-insensitively
+// on lookups, in and has checks, so req_headers['x-forwarded-for'] finds the X-Forwarded-For
+// header. The declared type of the variables does not change
+func NewHeaderMap(h map[string][]string) ref.Val {
+	if h == nil {
+		h = map[string][]string{}
+	}
+	mapper, _ := types.DefaultTypeAdapter.NativeToValue(h).(traits.Mapper)
+	return headerMap{Mapper: mapper, headers: h}
+}
+
+type headerMap struct {
+	traits.Mapper
+	headers map[string][]string
+}
+
+func (h headerMap) Contains(key ref.Val) ref.Val {
+	if _, ok := key.(types.String); !ok {
+		return h.Mapper.Contains(key)
+	}
+	_, found := h.lookup(key)
+	return types.Bool(found)
+}
+
+func (h headerMap) Get(key ref.Val) ref.Val {
+	if name, ok := h.lookup(key); ok {
+		return h.Mapper.Get(name)
+	}
+	return h.Mapper.Get(key)
+}
+
+func (h headerMap) Find(key ref.Val) (ref.Val, bool) {
+	if name, ok := h.lookup(key); ok {
+		return h.Mapper.Find(name)
+	}
+	return h.Mapper.Find(key)
+}
+
+// lookup returns the name of the header matching the key, trying the exact and canonical
+// names before comparing all the names
+func (h headerMap) lookup(key ref.Val) (types.String, bool) {
+	s, ok := key.(types.String)
+	if !ok {
+		return "", false
+	}
+	name := string(s)
+	if _, ok := h.headers[name]; ok {
+		return s, true
+	}
+	if c := textproto.CanonicalMIMEHeaderKey(name); c != name {
+		if _, ok := h.headers[c]; ok {
+			return types.String(c), true
+		}
+	}
+	for k := range h.headers {
+		if strings.EqualFold(k, name) {
+			return types.String(k), true
+		}
+	}
+	return "", false
+}
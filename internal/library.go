@@ -0,0 +1,298 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+)
+
+// ErrMacroCycle is returned when a macro references itself, directly or through other macros
+type ErrMacroCycle string
+
+func (e ErrMacroCycle) Error() string {
+	return fmt.Sprintf("cel: the macro %q references itself", string(e))
+}
+
+// ErrDuplicatedName is returned when a constant or a macro shadows a declared variable or
+// another library entry
+type ErrDuplicatedName string
+
+func (e ErrDuplicatedName) Error() string {
+	return fmt.Sprintf("cel: the name %q is already declared", string(e))
+}
+
+// ErrMacro wraps the errors found when resolving a macro
+type ErrMacro struct {
+	Name string
+	Err  error
+}
+
+func (e ErrMacro) Error() string {
+	return fmt.Sprintf("cel: macro %q: %s", e.Name, e.Err.Error())
+}
+
+func (e ErrMacro) Unwrap() error {
+	return e.Err
+}
+
+// Library holds the constants, macros and named rules shared by the definitions. The macros
+// are resolved against the default environment when the library is built and inlined into
+// the expressions referencing them, so the programs do not depend on the library at runtime
+type Library struct {
+	id         string
+	constants  map[string]interface{}
+	macros     map[string]*cel.Ast
+	order      []string
+	NamedRules map[string]InterpretableDefinition
+
+	mu   sync.Mutex
+	envs map[*cel.Env]*cel.Env
+}
+
+// NewLibrary returns the library declared by the configs. The entries of the later configs
+// override the ones of the previous configs, so the endpoint and backend configs can extend
+// the service one. It returns nil if nothing is declared
+func NewLibrary(cfgs ...Config) (*Library, error) {
+	constants := map[string]interface{}{}
+	macros := map[string]string{}
+	rules := map[string]InterpretableDefinition{}
+	for _, cfg := range cfgs {
+		for k, v := range cfg.Constants {
+			constants[k] = v
+		}
+		for k, v := range cfg.Macros {
+			macros[k] = v
+		}
+		for k, v := range cfg.NamedRules {
+			rules[k] = v
+		}
+	}
+	if len(constants)+len(macros)+len(rules) == 0 {
+		return nil, nil
+	}
+
+	l := &Library{
+		id:         libraryKey(constants, macros),
+		constants:  make(map[string]interface{}, len(constants)),
+		macros:     make(map[string]*cel.Ast, len(macros)),
+		NamedRules: rules,
+		envs:       map[*cel.Env]*cel.Env{},
+	}
+
+	env, err := DefaultEnv()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range constants {
+		if _, found := macros[k]; found || isDeclared(env, k) {
+			return nil, ErrDuplicatedName(k)
+		}
+		l.constants[k] = normalizeConstant(v)
+	}
+	for k := range macros {
+		if isDeclared(env, k) {
+			return nil, ErrDuplicatedName(k)
+		}
+	}
+	if env, err = l.withConstants(env); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(macros))
+	for k := range macros {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := l.resolve(env, name, macros, map[string]bool{}); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// resolve checks the macro and inlines the macros it references, resolving them first. The
+// macros being resolved are tracked in visiting, so reference cycles are detected
+func (l *Library) resolve(env *cel.Env, name string, macros map[string]string, visiting map[string]bool) error {
+	if _, ok := l.macros[name]; ok {
+		return nil
+	}
+	if visiting[name] {
+		return ErrMacroCycle(name)
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+
+	// the references to other macros are found by checking the expression with all the
+	// pending macros declared as dynamic variables
+	var pending []cel.EnvOption
+	for k := range macros {
+		if _, ok := l.macros[k]; !ok {
+			pending = append(pending, cel.Variable(k, cel.DynType))
+		}
+	}
+	probeEnv, err := env.Extend(append(l.macroDeclarations(), pending...)...)
+	if err != nil {
+		return err
+	}
+	probe, iss := probeEnv.Compile(macros[name])
+	if iss != nil && iss.Err() != nil {
+		return ErrMacro{Name: name, Err: iss.Err()}
+	}
+	for _, ref := range probe.NativeRep().ReferenceMap() {
+		if _, ok := macros[ref.Name]; ok {
+			if err := l.resolve(env, ref.Name, macros, visiting); err != nil {
+				return err
+			}
+		}
+	}
+
+	macroEnv, err := env.Extend(l.macroDeclarations()...)
+	if err != nil {
+		return err
+	}
+	checked, iss := macroEnv.Compile(macros[name])
+	if iss != nil && iss.Err() != nil {
+		return ErrMacro{Name: name, Err: iss.Err()}
+	}
+	if checked, err = l.inline(macroEnv, checked); err != nil {
+		return ErrMacro{Name: name, Err: err}
+	}
+	l.macros[name] = checked
+	l.order = append(l.order, name)
+	return nil
+}
+
+// Env returns the given environment extended with the declarations of the library
+func (l *Library) Env(env *cel.Env) (*cel.Env, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.envs[env]; ok {
+		return e, nil
+	}
+	e, err := l.withConstants(env)
+	if err != nil {
+		return nil, err
+	}
+	if e, err = e.Extend(l.macroDeclarations()...); err != nil {
+		return nil, err
+	}
+	l.envs[env] = e
+	return e, nil
+}
+
+func (l *Library) withConstants(env *cel.Env) (*cel.Env, error) {
+	if len(l.constants) == 0 {
+		return env, nil
+	}
+	opts := make([]cel.EnvOption, 0, len(l.constants))
+	for k, v := range l.constants {
+		opts = append(opts, cel.Constant(k, constantType(v), types.DefaultTypeAdapter.NativeToValue(v)))
+	}
+	return env.Extend(opts...)
+}
+
+// macroDeclarations declares the resolved macros as variables of the type of their expression
+func (l *Library) macroDeclarations() []cel.EnvOption {
+	res := make([]cel.EnvOption, 0, len(l.order))
+	for _, name := range l.order {
+		res = append(res, cel.Variable(name, l.macros[name].OutputType()))
+	}
+	return res
+}
+
+// inline replaces the references to the macros of the library with their expressions
+func (l *Library) inline(env *cel.Env, checked *cel.Ast) (*cel.Ast, error) {
+	var vars []*cel.InlineVariable
+	for _, ref := range checked.NativeRep().ReferenceMap() {
+		if m, ok := l.macros[ref.Name]; ok {
+			vars = append(vars, cel.NewInlineVariable(ref.Name, m))
+		}
+	}
+	if len(vars) == 0 {
+		return checked, nil
+	}
+	optimized, iss := cel.NewStaticOptimizer(cel.NewInliningOptimizer(vars...)).Optimize(env, checked)
+	if iss != nil && iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	return optimized, nil
+}
+
+// key identifies the library in the program cache
+func (l *Library) key() string {
+	if l == nil {
+		return ""
+	}
+	return l.id
+}
+
+// libraryKey returns a digest of the constants and macros, so the programs compiled with
+// identical libraries are shared
+func libraryKey(constants map[string]interface{}, macros map[string]string) string {
+	b, _ := json.Marshal([]interface{}{constants, macros})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+func isDeclared(env *cel.Env, name string) bool {
+	for _, v := range env.Variables() {
+		if v.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeConstant converts the whole numbers decoded from JSON into integers, so they can be
+// compared with the integer variables
+func normalizeConstant(v interface{}) interface{} {
+	switch t := v.(type) {
+	case float64:
+		if t == math.Trunc(t) && math.Abs(t) < 1<<53 {
+			return int64(t)
+		}
+	case int:
+		return int64(t)
+	case []interface{}:
+		res := make([]interface{}, len(t))
+		for i, e := range t {
+			res[i] = normalizeConstant(e)
+		}
+		return res
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			res[k] = normalizeConstant(e)
+		}
+		return res
+	}
+	return v
+}
+
+func constantType(v interface{}) *cel.Type {
+	switch v.(type) {
+	case bool:
+		return cel.BoolType
+	case int64:
+		return cel.IntType
+	case float64:
+		return cel.DoubleType
+	case string:
+		return cel.StringType
+	case []interface{}:
+		return cel.ListType(cel.DynType)
+	case map[string]interface{}:
+		return cel.MapType(cel.StringType, cel.DynType)
+	case nil:
+		return cel.NullType
+	}
+	return cel.DynType
+}
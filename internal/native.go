@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+)
+
+// ToNative converts the result of a CEL evaluation into plain go values, recursively
+// translating CEL maps and lists into map[string]interface{} and []interface{}
+func ToNative(v ref.Val) interface{} {
+	switch t := v.(type) {
+	case types.Null:
+		return nil
+	case traits.Mapper:
+		res := map[string]interface{}{}
+		for it := t.Iterator(); it.HasNext() == types.True; {
+			k := it.Next()
+			res[fmt.Sprintf("%v", k.Value())] = ToNative(t.Get(k))
+		}
+		return res
+	case traits.Lister:
+		size, _ := t.Size().Value().(int64)
+		res := make([]interface{}, 0, size)
+		for it := t.Iterator(); it.HasNext() == types.True; {
+			res = append(res, ToNative(it.Next()))
+		}
+		return res
+	}
+	return v.Value()
+}
+
+// ToStringSlice converts a native value into a slice of strings. Single values are
+// wrapped into a slice of one element
+func ToStringSlice(v interface{}) []string {
+	switch t := v.(type) {
+	case []string:
+		return t
+	case []interface{}:
+		res := make([]string, len(t))
+		for i, e := range t {
+			res[i] = fmt.Sprintf("%v", e)
+		}
+		return res
+	}
+	return []string{fmt.Sprintf("%v", v)}
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// timeFunctions declares the helpers for timezone aware checks over timestamps:
+//
+//	now.isWeekday('Europe/Madrid') // true from monday to friday in the given zone
+//	now.inTimeRange('09:00', '17:30', 'America/New_York') // true if the local time is in [from, to)
+//
+// Ranges where from is after to wrap around midnight, so '22:00' to '06:00' covers the night
+func timeFunctions() cel.EnvOption {
+	return cel.Lib(timeLib{})
+}
+
+type timeLib struct{}
+
+func (timeLib) CompileOptions() []cel.EnvOption {
+	return []cel.EnvOption{
+		cel.Function("isWeekday",
+			cel.MemberOverload("timestamp_is_weekday_string",
+				[]*cel.Type{cel.TimestampType, cel.StringType}, cel.BoolType,
+				cel.BinaryBinding(isWeekday),
+			),
+		),
+		cel.Function("inTimeRange",
+			cel.MemberOverload("timestamp_in_time_range_string_string_string",
+				[]*cel.Type{cel.TimestampType, cel.StringType, cel.StringType, cel.StringType}, cel.BoolType,
+				cel.FunctionBinding(inTimeRange),
+			),
+		),
+	}
+}
+
+func (timeLib) ProgramOptions() []cel.ProgramOption {
+	return []cel.ProgramOption{}
+}
+
+func isWeekday(ts, zone ref.Val) ref.Val {
+	t, err := localTime(ts, zone)
+	if err != nil {
+		return types.NewErrFromString(err.Error())
+	}
+	d := t.Weekday()
+	return types.Bool(d != time.Saturday && d != time.Sunday)
+}
+
+func inTimeRange(args ...ref.Val) ref.Val {
+	t, err := localTime(args[0], args[3])
+	if err != nil {
+		return types.NewErrFromString(err.Error())
+	}
+	from, err := minuteOfDay(args[1])
+	if err != nil {
+		return types.NewErrFromString(err.Error())
+	}
+	to, err := minuteOfDay(args[2])
+	if err != nil {
+		return types.NewErrFromString(err.Error())
+	}
+
+	current := t.Hour()*60 + t.Minute()
+	if from <= to {
+		return types.Bool(current >= from && current < to)
+	}
+	return types.Bool(current >= from || current < to)
+}
+
+func localTime(ts, zone ref.Val) (time.Time, error) {
+	t, ok := ts.(types.Timestamp)
+	if !ok {
+		return time.Time{}, fmt.Errorf("unexpected timestamp %v", ts)
+	}
+	name, ok := zone.(types.String)
+	if !ok {
+		return time.Time{}, fmt.Errorf("unexpected time zone %v", zone)
+	}
+	loc, err := loadLocation(string(name))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.Time.In(loc), nil
+}
+
+func minuteOfDay(v ref.Val) (int, error) {
+	s, ok := v.(types.String)
+	if !ok {
+		return 0, fmt.Errorf("unexpected time %v", v)
+	}
+	t, err := time.Parse("15:04", string(s))
+	if err != nil {
+		return 0, fmt.Errorf("unexpected time %q: use the HH:MM format", string(s))
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+var locations sync.Map
+
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
@@ -0,0 +1,122 @@
+package cel
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/krakend/krakend-cel/v2/internal"
+	"github.com/luraproject/lura/v2/logging"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	outcomePass   = "pass"
+	outcomeReject = "reject"
+	outcomeError  = "error"
+	// the outcomes of the failed checks of the rules in audit mode, letting the request through
+	outcomeAuditReject = "audit_reject"
+	outcomeAuditError  = "audit_error"
+)
+
+// metrics holds the instruments measuring the evaluation of the rules
+type metrics struct {
+	evaluations metric.Int64Counter
+	passes      metric.Int64Counter
+	rejections  metric.Int64Counter
+	errors      metric.Int64Counter
+	audits      metric.Int64Counter
+	duration    metric.Float64Histogram
+}
+
+func newMetrics(l logging.Logger, m metric.Meter) *metrics {
+	if m == nil {
+		m = noop.NewMeterProvider().Meter(internal.Namespace)
+	}
+	res, err := buildMetrics(m)
+	if err != nil {
+		l.Warning("[CEL] Unable to create the metric instruments:", err.Error())
+		res, _ = buildMetrics(noop.NewMeterProvider().Meter(internal.Namespace))
+	}
+	return res
+}
+
+func buildMetrics(m metric.Meter) (*metrics, error) {
+	res := &metrics{}
+	var err error
+	if res.evaluations, err = m.Int64Counter("krakend.cel.evaluations",
+		metric.WithDescription("Number of rule evaluations"), metric.WithUnit("{evaluation}")); err != nil {
+		return nil, err
+	}
+	if res.passes, err = m.Int64Counter("krakend.cel.passes",
+		metric.WithDescription("Number of rule evaluations letting the request through"), metric.WithUnit("{evaluation}")); err != nil {
+		return nil, err
+	}
+	if res.rejections, err = m.Int64Counter("krakend.cel.rejections",
+		metric.WithDescription("Number of rule evaluations rejecting the request"), metric.WithUnit("{evaluation}")); err != nil {
+		return nil, err
+	}
+	if res.errors, err = m.Int64Counter("krakend.cel.errors",
+		metric.WithDescription("Number of rule evaluations failing with an error"), metric.WithUnit("{evaluation}")); err != nil {
+		return nil, err
+	}
+	if res.audits, err = m.Int64Counter("krakend.cel.audit.rejections",
+		metric.WithDescription("Number of rule evaluations in audit mode that would have rejected the request"), metric.WithUnit("{evaluation}")); err != nil {
+		return nil, err
+	}
+	if res.duration, err = m.Float64Histogram("krakend.cel.duration",
+		metric.WithDescription("Duration of the rule evaluations"), metric.WithUnit("s")); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// observer logs, measures and traces the evaluation of the rules of a proxy or a rejecter
+type observer struct {
+	l       logging.Logger
+	name    string
+	phase   string
+	metrics *metrics
+	tracer  trace.Tracer
+	attrs   []attribute.KeyValue
+}
+
+func newObserver(l logging.Logger, name string, m *metrics, t trace.Tracer, attrs ...attribute.KeyValue) observer {
+	return observer{l: l, name: name, metrics: m, tracer: t, attrs: attrs}
+}
+
+// inPhase returns a copy of the observer for the evaluations of the given phase
+func (o observer) inPhase(phase string) observer {
+	o.name += "[" + phase + "]"
+	o.phase = phase
+	o.attrs = append(o.attrs[:len(o.attrs):len(o.attrs)], attribute.String("krakend.cel.phase", phase))
+	return o
+}
+
+// record registers the outcome of a rule evaluation
+func (o observer) record(ctx context.Context, eval internal.Evaluator, outcome string, start time.Time, res ref.Val, det *cel.EvalDetails) {
+	ruleAttrs := append(o.attrs[:len(o.attrs):len(o.attrs)],
+		attribute.String("krakend.cel.rule", eval.ID()),
+		attribute.String("krakend.cel.outcome", outcome),
+	)
+	addRuleEvent(ctx, ruleAttrs, res, det)
+
+	attrs := metric.WithAttributes(ruleAttrs...)
+
+	o.metrics.evaluations.Add(ctx, 1, attrs)
+	o.metrics.duration.Record(ctx, time.Since(start).Seconds(), attrs)
+	switch outcome {
+	case outcomePass:
+		o.metrics.passes.Add(ctx, 1, attrs)
+	case outcomeReject:
+		o.metrics.rejections.Add(ctx, 1, attrs)
+	case outcomeError:
+		o.metrics.errors.Add(ctx, 1, attrs)
+	case outcomeAuditReject, outcomeAuditError:
+		o.metrics.audits.Add(ctx, 1, attrs)
+	}
+}
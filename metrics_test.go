@@ -0,0 +1,83 @@
+package cel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/krakend/krakend-cel/v2/internal"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/logging"
+	"github.com/luraproject/lura/v2/proxy"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestProxyFactory_metrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse), WithMeter(meter)).New(&config.EndpointConfig{
+		Endpoint: "/foo",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{Name: "only-get", CheckExpression: "req_method == 'GET'"},
+				{CheckExpression: "int(req_params.Id) > 0"},
+				{Name: "audited", CheckExpression: "req_params.Id != '1'", Mode: internal.AuditMode},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, r := range []*proxy.Request{
+		{Method: "GET", Params: map[string]string{"Id": "1"}},
+		{Method: "POST", Params: map[string]string{"Id": "1"}},
+		{Method: "GET", Params: map[string]string{"Id": "foo"}},
+	} {
+		prxy(context.Background(), r)
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := map[string]int64{
+		"krakend.cel.evaluations":      6,
+		"krakend.cel.passes":           3,
+		"krakend.cel.rejections":       1,
+		"krakend.cel.errors":           1,
+		"krakend.cel.audit.rejections": 1,
+	}
+	found := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, dp := range data.DataPoints {
+					if v, ok := dp.Attributes.Value("krakend.endpoint"); !ok || v.AsString() != "/foo" {
+						t.Errorf("%s: unexpected attributes %v", m.Name, dp.Attributes)
+					}
+					found[m.Name] += dp.Value
+				}
+			case metricdata.Histogram[float64]:
+				for _, dp := range data.DataPoints {
+					found[m.Name] += int64(dp.Count)
+				}
+			}
+		}
+	}
+
+	for name, v := range expected {
+		if found[name] != v {
+			t.Errorf("%s: unexpected value. have %d, want %d", name, found[name], v)
+		}
+	}
+	if found["krakend.cel.duration"] != 6 {
+		t.Errorf("unexpected number of duration measures: %d", found["krakend.cel.duration"])
+	}
+}
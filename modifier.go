@@ -0,0 +1,302 @@
+package cel
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/krakend/krakend-cel/v2/internal"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+)
+
+// backendOnlyKeys are the request variables overwritten by the request builder of the backends,
+// so modifying them is only effective at backend level
+var backendOnlyKeys = []string{internal.PreKey + "_method", internal.PreKey + "_path"}
+
+// evalReqMods applies the modifiers to the request. At backend level (a non nil backend), the
+// URL built by the load balancer is rebuilt when the path, the params or the query change
+func evalReqMods(ctx context.Context, obs observer, r *proxy.Request, now time.Time, body map[string]interface{}, ps []internal.Evaluator, backend *config.Backend) error {
+	var pathUpdated, paramsUpdated, queryUpdated bool
+	for _, mod := range ps {
+		mods, err := evalMod(ctx, obs, mod, internal.NewReqActivation(r, now, body))
+		if err != nil {
+			obs.l.Info(fmt.Sprintf("%s Modifier %s failed: %s", obs.name, mod.ID(), err.Error()))
+			return fmt.Errorf("request aborted by modifier %s", mod.ID())
+		}
+		obs.l.Debug(fmt.Sprintf("%s Modifier %s result: %v", obs.name, mod.ID(), mods))
+
+		for k, v := range mods {
+			if (backend == nil && slices.Contains(backendOnlyKeys, k)) || !applyReqMod(r, k, v) {
+				obs.l.Debug(fmt.Sprintf("%s Modifier %s: ignoring the modification of %s", obs.name, mod.ID(), k))
+				continue
+			}
+			switch k {
+			case internal.PreKey + "_path":
+				pathUpdated = true
+			case internal.PreKey + "_params":
+				paramsUpdated = true
+			case internal.PreKey + "_querystring":
+				queryUpdated = true
+			}
+		}
+	}
+
+	if backend == nil || r.URL == nil || !(pathUpdated || paramsUpdated || queryUpdated) {
+		return nil
+	}
+	if paramsUpdated && !pathUpdated {
+		r.GeneratePath(backend.URLPattern)
+	}
+	if err := rebuildURL(r); err != nil {
+		obs.l.Info(obs.name, "Unable to rebuild the request URL:", err.Error())
+		return err
+	}
+	return nil
+}
+
+// rebuildURL replaces the path and the query of the URL of the request, the same way the load
+// balancer builds it from the selected host
+func rebuildURL(r *proxy.Request) error {
+	host := url.URL{Scheme: r.URL.Scheme, User: r.URL.User, Host: r.URL.Host}
+	u, err := url.Parse(host.String() + r.Path)
+	if err != nil {
+		return err
+	}
+	if len(r.Query) > 0 {
+		if len(u.RawQuery) > 0 {
+			u.RawQuery += "&" + r.Query.Encode()
+		} else {
+			u.RawQuery = r.Query.Encode()
+		}
+	}
+	r.URL = u
+	return nil
+}
+
+// checkEndpointMods reports the modifiers of an endpoint updating the variables only effective
+// at backend level
+func checkEndpointMods(obs observer, mods []internal.Evaluator, strict bool) error {
+	for _, mod := range mods {
+		for _, key := range mod.UpdatedKeys() {
+			if !slices.Contains(backendOnlyKeys, key) {
+				continue
+			}
+			err := fmt.Errorf("modifier %s: %w: %s", mod.ID(), errBackendOnlyMod, key)
+			if strict {
+				return err
+			}
+			obs.l.Warning(obs.name, err.Error())
+		}
+	}
+	return nil
+}
+
+func evalRespMods(ctx context.Context, obs observer, r *proxy.Response, now time.Time, body []byte, ps []internal.Evaluator) error {
+	for _, mod := range ps {
+		mods, err := evalMod(ctx, obs, mod, internal.NewRespActivation(r, nil, now, body))
+		if err != nil {
+			obs.l.Info(fmt.Sprintf("%s Modifier %s failed: %s", obs.name, mod.ID(), err.Error()))
+			return fmt.Errorf("request aborted by modifier %s", mod.ID())
+		}
+		obs.l.Debug(fmt.Sprintf("%s Modifier %s result: %v", obs.name, mod.ID(), mods))
+
+		for k, v := range mods {
+			if !applyRespMod(r, k, v) {
+				obs.l.Debug(fmt.Sprintf("%s Modifier %s: ignoring the modification of %s", obs.name, mod.ID(), k))
+			}
+		}
+	}
+	return nil
+}
+
+// evalErrorMods applies the modifiers to a failed execution. Setting resp_error to null
+// discards the error, so the (modified) response is returned to the client, while setting
+// resp_error or resp_error_status replaces the returned error
+func evalErrorMods(ctx context.Context, obs observer, resp *proxy.Response, err error, now time.Time, body []byte, ps []internal.Evaluator) (*proxy.Response, error) {
+	r := resp
+	if r == nil {
+		r = &proxy.Response{Data: map[string]interface{}{}, Metadata: proxy.Metadata{Headers: map[string][]string{}}}
+	}
+	for _, mod := range ps {
+		mods, evalErr := evalMod(ctx, obs, mod, internal.NewRespActivation(r, err, now, body))
+		if evalErr != nil {
+			obs.l.Info(fmt.Sprintf("%s Modifier %s failed: %s", obs.name, mod.ID(), evalErr.Error()))
+			return nil, fmt.Errorf("request aborted by modifier %s", mod.ID())
+		}
+		obs.l.Debug(fmt.Sprintf("%s Modifier %s result: %v", obs.name, mod.ID(), mods))
+
+		if v, ok := mods[internal.PostKey+"_error"]; ok && v == nil {
+			err = nil
+		}
+
+		for k, v := range mods {
+			ok := true
+			switch k {
+			case internal.PostKey + "_error":
+				if msg, isString := v.(string); isString && err != nil {
+					err = replaceError(err, msg, internal.ErrorStatusCode(err))
+				} else {
+					ok = v == nil
+				}
+			case internal.PostKey + "_error_status":
+				if code, isInt := v.(int64); isInt && err != nil {
+					err = replaceError(err, err.Error(), int(code))
+				} else {
+					ok = false
+				}
+			default:
+				ok = applyRespMod(r, k, v)
+			}
+			if !ok {
+				obs.l.Debug(fmt.Sprintf("%s Modifier %s: ignoring the modification of %s", obs.name, mod.ID(), k))
+			}
+		}
+	}
+	if err != nil {
+		return resp, err
+	}
+	return r, nil
+}
+
+func evalMod(ctx context.Context, obs observer, mod internal.Evaluator, args map[string]interface{}) (map[string]interface{}, error) {
+	start := time.Now()
+	res, det, err := mod.ContextEval(ctx, args)
+	if err != nil {
+		obs.record(ctx, mod, outcomeError, start, res, det)
+		return nil, err
+	}
+	mods, ok := internal.ToNative(res).(map[string]interface{})
+	if !ok {
+		obs.record(ctx, mod, outcomeError, start, res, det)
+		return nil, fmt.Errorf("unexpected result type %s", res.Type().TypeName())
+	}
+	obs.record(ctx, mod, outcomePass, start, res, det)
+	return mods, nil
+}
+
+// applyReqMod updates the request part referenced by the key. Maps are merged with the
+// existing values and keys with a null value are removed from the request
+func applyReqMod(r *proxy.Request, k string, v interface{}) bool {
+	switch k {
+	case internal.PreKey + "_method":
+		s, ok := v.(string)
+		if ok {
+			r.Method = s
+		}
+		return ok
+	case internal.PreKey + "_path":
+		s, ok := v.(string)
+		if ok {
+			r.Path = s
+		}
+		return ok
+	case internal.PreKey + "_params":
+		m, ok := v.(map[string]interface{})
+		if ok {
+			r.Params = mergeParams(r.Params, m)
+		}
+		return ok
+	case internal.PreKey + "_headers":
+		m, ok := v.(map[string]interface{})
+		if ok {
+			r.Headers = mergeValues(r.Headers, m)
+		}
+		return ok
+	case internal.PreKey + "_querystring":
+		m, ok := v.(map[string]interface{})
+		if ok {
+			r.Query = mergeValues(r.Query, m)
+		}
+		return ok
+	}
+	return false
+}
+
+// applyRespMod updates the response part referenced by the key. Maps are merged with the
+// existing values and keys with a null value are removed from the response
+func applyRespMod(r *proxy.Response, k string, v interface{}) bool {
+	switch k {
+	case internal.PostKey + "_completed":
+		b, ok := v.(bool)
+		if ok {
+			r.IsComplete = b
+		}
+		return ok
+	case internal.PostKey + "_metadata_status":
+		i, ok := v.(int64)
+		if ok {
+			r.Metadata.StatusCode = int(i)
+		}
+		return ok
+	case internal.PostKey + "_metadata_headers":
+		m, ok := v.(map[string]interface{})
+		if ok {
+			r.Metadata.Headers = mergeValues(r.Metadata.Headers, m)
+		}
+		return ok
+	case internal.PostKey + "_data":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		data := make(map[string]interface{}, len(r.Data)+len(m))
+		for k, v := range r.Data {
+			data[k] = v
+		}
+		for k, v := range m {
+			if v == nil {
+				delete(data, k)
+				continue
+			}
+			data[k] = v
+		}
+		r.Data = data
+		return true
+	case internal.PostKey + "_collection":
+		l, ok := v.([]interface{})
+		if !ok {
+			return false
+		}
+		data := make(map[string]interface{}, len(r.Data)+1)
+		for k, v := range r.Data {
+			data[k] = v
+		}
+		data[internal.CollectionKey] = l
+		r.Data = data
+		return true
+	}
+	return false
+}
+
+func mergeParams(original map[string]string, m map[string]interface{}) map[string]string {
+	res := make(map[string]string, len(original)+len(m))
+	for k, v := range original {
+		res[k] = v
+	}
+	for k, v := range m {
+		if v == nil {
+			delete(res, k)
+			continue
+		}
+		res[k] = fmt.Sprintf("%v", v)
+	}
+	return res
+}
+
+func mergeValues(original map[string][]string, m map[string]interface{}) map[string][]string {
+	res := make(map[string][]string, len(original)+len(m))
+	for k, v := range original {
+		res[k] = v
+	}
+	for k, v := range m {
+		if v == nil {
+			delete(res, k)
+			continue
+		}
+		res[k] = internal.ToStringSlice(v)
+	}
+	return res
+}
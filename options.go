@@ -0,0 +1,166 @@
+package cel
+
+import (
+	"time"
+
+	"github.com/krakend/krakend-cel/v2/internal"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Option customizes the factories and rejecters of the module
+type Option func(*options)
+
+type options struct {
+	strict    bool
+	meter     metric.Meter
+	tracer    trace.Tracer
+	costLimit uint64
+	configDir string
+	// serviceConfig is the raw service config, decoded by newOptions into service and library
+	serviceConfig config.ExtraConfig
+	service       internal.Config
+	library       *internal.Library
+	source        *RuleSource
+	clock         func() time.Time
+	claimsVars    []string
+	// explain enables the explanation of the failed checks, added to the rejections of the
+	// trusted requests in the explainHeader
+	explain        bool
+	explainHeader  string
+	explainTrusted func(*proxy.Request) bool
+	// serviceErr reports a service config that can not be decoded or resolved
+	serviceErr error
+}
+
+// WithStrictMode sets the default validation mode for the endpoints and backends not declaring
+// their own. In strict mode, any error parsing or checking the expressions is returned by the
+// factories instead of falling back to the next proxy, so the gateway refuses to start
+func WithStrictMode(strict bool) Option {
+	return func(o *options) {
+		o.strict = strict
+	}
+}
+
+// WithMeter sets the meter used to create the instruments measuring the rule evaluations. The
+// evaluations are not measured by default
+func WithMeter(m metric.Meter) Option {
+	return func(o *options) {
+		o.meter = m
+	}
+}
+
+// WithTracer sets the tracer used to create the spans covering the evaluation of the pre and
+// post phases. The evaluations are not traced by default
+func WithTracer(t trace.Tracer) Option {
+	return func(o *options) {
+		o.tracer = t
+	}
+}
+
+// WithCostLimit sets the default cost limit for the rules not declaring their own. Rules with
+// an estimated worst-case cost over the limit are rejected when loading them, and evaluations
+// exceeding it are aborted. Zero, the default, means no limit
+func WithCostLimit(limit uint64) Option {
+	return func(o *options) {
+		o.costLimit = limit
+	}
+}
+
+// WithServiceConfig sets the service level config of the module, declaring the constants,
+// macros and named rules available to the rules of every endpoint and backend. The endpoints
+// and backends can declare their own ones, overriding the service entries with the same name
+func WithServiceConfig(e config.ExtraConfig) Option {
+	return func(o *options) {
+		o.serviceConfig = e
+	}
+}
+
+// DefaultConfigDir is the directory used to resolve the relative paths of the policy files and
+// bundles when WithConfigDir is not set: the working directory of the process
+const DefaultConfigDir = "."
+
+// WithConfigDir sets the directory used to resolve the relative paths of the policy files and
+// bundles. It should be the directory of the configuration file, as the linter resolves the
+// paths from it. Defaults to DefaultConfigDir
+func WithConfigDir(dir string) Option {
+	return func(o *options) {
+		o.configDir = dir
+	}
+}
+
+// WithRuleSource sets the source of the rules replacing the ones of the extra config at
+// runtime. Every endpoint, backend and rejecter built with the option is registered in the
+// source, even the ones without rules in their extra config
+func WithRuleSource(s *RuleSource) Option {
+	return func(o *options) {
+		o.source = s
+	}
+}
+
+// WithClaimsVariables declares the variables of the claims rejecters of the gateway (see
+// NewClaimsRejecter), so the proxies and the rest of rejecters sharing the extra config skip the
+// definitions referencing them instead of failing to check them, which stops the gateway in
+// strict mode
+func WithClaimsVariables(names ...string) Option {
+	return func(o *options) {
+		o.claimsVars = names
+	}
+}
+
+// WithClock sets the function returning the time exposed as the now variable, so the rules
+// depending on it can be evaluated at a fixed time. Defaults to the system clock
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		o.clock = now
+	}
+}
+
+// WithExplain enables the explain mode: the values of the sub-expressions of the rules
+// rejecting a request are logged at debug level. When header is not empty, they are also added
+// in that header to the rejections of the requests accepted by trusted, sending the rejections
+// without a status code with the 500 one. Tracking the values adds some overhead to every
+// evaluation
+func WithExplain(header string, trusted func(r *proxy.Request) bool) Option {
+	return func(o *options) {
+		o.explain = true
+		o.explainHeader = header
+		o.explainTrusted = trusted
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.configDir == "" {
+		o.configDir = DefaultConfigDir
+	}
+	if _, ok := o.serviceConfig[internal.Namespace]; ok {
+		o.service, o.library, o.serviceErr = newServiceLibrary(o.serviceConfig, o.configDir)
+	}
+	return o
+}
+
+func newServiceLibrary(e config.ExtraConfig, dir string) (internal.Config, *internal.Library, error) {
+	cfg, ok := internal.ConfigGetter(e)
+	if !ok {
+		return cfg, nil, errWrongConfig
+	}
+	cfg, err := cfg.Resolve(dir)
+	if err != nil {
+		return cfg, nil, err
+	}
+	lib, err := internal.NewLibrary(cfg)
+	return cfg, lib, err
+}
+
+func (o options) now() time.Time {
+	if o.clock != nil {
+		return o.clock()
+	}
+	return timeNow()
+}
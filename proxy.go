@@ -2,17 +2,21 @@ package cel
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
-	"github.com/google/cel-go/cel"
 	"github.com/krakend/krakend-cel/v2/internal"
 	"github.com/luraproject/lura/v2/config"
 	"github.com/luraproject/lura/v2/logging"
 	"github.com/luraproject/lura/v2/proxy"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func ProxyFactory(l logging.Logger, pf proxy.Factory) proxy.Factory {
+func ProxyFactory(l logging.Logger, pf proxy.Factory, opts ...Option) proxy.Factory {
+	o := newOptions(opts)
+	m := newMetrics(l, o.meter)
+	t := newTracer(o.tracer)
 	return proxy.FactoryFunc(func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
 		logPrefix := "[ENDPOINT: " + cfg.Endpoint + "][CEL]"
 		next, err := pf.New(cfg)
@@ -20,45 +24,96 @@ func ProxyFactory(l logging.Logger, pf proxy.Factory) proxy.Factory {
 			return next, err
 		}
 
+		obs := newObserver(l, logPrefix, m, t, attribute.String("krakend.endpoint", cfg.Endpoint))
+		reloadable := func(p proxy.Proxy) proxy.Proxy {
+			if o.source == nil {
+				return p
+			}
+			return o.source.registerProxy(EndpointKey(cfg), p, reloadBuilder(p, obs, next, o, nil))
+		}
+
 		def, ok := internal.ConfigGetter(cfg.ExtraConfig)
 		if !ok {
-			return next, nil
+			if _, found := cfg.ExtraConfig[internal.Namespace]; found && o.strict {
+				return proxy.NoopProxy, fmt.Errorf("%s %w", logPrefix, errWrongConfig)
+			}
+			return reloadable(next), nil
 		}
 		l.Debug(logPrefix, "Loading configuration")
 
-		p, err := newProxy(l, logPrefix, def, next)
+		strict := def.IsStrict(o.strict)
+		p, err := newProxy(obs, def, next, o, nil)
 		if err != nil {
+			if strict {
+				l.Error(logPrefix, "Error parsing the definitions:", err.Error())
+				return proxy.NoopProxy, fmt.Errorf("%s %w", logPrefix, err)
+			}
 			l.Warning(logPrefix, "Error parsing the definitions:", err.Error())
 			l.Warning(logPrefix, "Falling back to the next pipe proxy")
-			return next, nil
+			return reloadable(next), nil
 		}
-		return p, err
+		return reloadable(p), nil
 	})
 }
 
-func BackendFactory(l logging.Logger, bf proxy.BackendFactory) proxy.BackendFactory {
+func BackendFactory(l logging.Logger, bf proxy.BackendFactory, opts ...Option) proxy.BackendFactory {
+	o := newOptions(opts)
+	m := newMetrics(l, o.meter)
+	t := newTracer(o.tracer)
 	return func(cfg *config.Backend) proxy.Proxy {
 		logPrefix := "[BACKEND: " + cfg.URLPattern + "][CEL]"
 		next := bf(cfg)
 
+		obs := newObserver(l, logPrefix, m, t, attribute.String("krakend.backend", cfg.URLPattern))
+		reloadable := func(p proxy.Proxy) proxy.Proxy {
+			if o.source == nil {
+				return p
+			}
+			return o.source.registerProxy(BackendKey(cfg), p, reloadBuilder(p, obs, next, o, cfg))
+		}
+
 		def, ok := internal.ConfigGetter(cfg.ExtraConfig)
 		if !ok {
-			return next
+			if _, found := cfg.ExtraConfig[internal.Namespace]; found && o.strict {
+				// the backend factory can not return errors, so the gateway is stopped
+				l.Fatal(logPrefix, errWrongConfig.Error())
+				return errorProxy(errWrongConfig)
+			}
+			return reloadable(next)
 		}
 		l.Debug(logPrefix, "Loading configuration")
 
-		p, err := newProxy(l, logPrefix, def, next)
+		strict := def.IsStrict(o.strict)
+		p, err := newProxy(obs, def, next, o, cfg)
 		if err != nil {
+			if strict {
+				l.Fatal(logPrefix, "Error parsing the definitions:", err.Error())
+				return errorProxy(err)
+			}
 			l.Warning(logPrefix, "Error parsing the definitions:", err.Error())
 			l.Warning(logPrefix, "Falling back to the next backend proxy")
-			return next
+			return reloadable(next)
 		}
-		return p
+		return reloadable(p)
 	}
 }
 
-func newProxy(l logging.Logger, name string, defs []internal.InterpretableDefinition, next proxy.Proxy) (proxy.Proxy, error) {
-	p := internal.NewCheckExpressionParser(l)
+// newProxy builds the proxy evaluating the rules of an endpoint or, when the backend is not nil,
+// of a backend
+func newProxy(obs observer, cfg internal.Config, next proxy.Proxy, o options, backend *config.Backend) (proxy.Proxy, error) {
+	l, name := obs.l, obs.name
+	cfg, err := cfg.Resolve(o.configDir)
+	if err != nil {
+		return proxy.NoopProxy, err
+	}
+	defs := cfg.Definitions
+	strict := cfg.IsStrict(o.strict)
+	lib, err := newLibrary(o, cfg)
+	if err != nil {
+		return proxy.NoopProxy, err
+	}
+	p := internal.NewCheckExpressionParser(l).WithStrict(strict).WithCostLimit(o.costLimit).WithLibrary(lib).
+		WithExplain(o.explain).WithClaimsVariables(o.claimsVars...)
 	preEvaluators, err := p.ParsePre(defs)
 	if err != nil {
 		return proxy.NoopProxy, err
@@ -68,68 +123,212 @@ func newProxy(l logging.Logger, name string, defs []internal.InterpretableDefini
 		return proxy.NoopProxy, err
 	}
 
+	m := internal.NewModExpressionParser(l).WithStrict(strict).WithCostLimit(o.costLimit).WithLibrary(lib).
+		WithClaimsVariables(o.claimsVars...)
+	preModifiers, err := m.ParsePre(defs)
+	if err != nil {
+		return proxy.NoopProxy, err
+	}
+	postModifiers, err := m.ParsePost(defs)
+	if err != nil {
+		return proxy.NoopProxy, err
+	}
+	if backend == nil {
+		if err := checkEndpointMods(obs, preModifiers, strict); err != nil {
+			return proxy.NoopProxy, err
+		}
+	}
+
 	l.Debug(name, fmt.Sprintf("%d preEvaluator(s) loaded", len(preEvaluators)))
 	l.Debug(name, fmt.Sprintf("%d postEvaluator(s) loaded", len(postEvaluators)))
+	l.Debug(name, fmt.Sprintf("%d preModifier(s) loaded", len(preModifiers)))
+	l.Debug(name, fmt.Sprintf("%d postModifier(s) loaded", len(postModifiers)))
+
+	errorEvaluators := filterOnError(postEvaluators)
+	errorModifiers := filterOnError(postModifiers)
+
+	pre, post := obs.inPhase(internal.PrePhase), obs.inPhase(internal.PostPhase)
+
+	readBody := cfg.ReqBody && len(preEvaluators)+len(preModifiers) > 0
+	// the response body is only read when an expression uses it, so the streamed responses of
+	// the rest are not buffered
+	readRespBody := cfg.RespBody && referencesAny(internal.PostKey+"_body", postEvaluators, postModifiers)
+	readErrorRespBody := cfg.RespBody && referencesAny(internal.PostKey+"_body", errorEvaluators, errorModifiers)
+	maxBodySize := cfg.BodySizeLimit()
+
+	hasPre := len(preEvaluators)+len(preModifiers) > 0
+	hasPost := len(postEvaluators)+len(postModifiers) > 0
+	hasOnError := len(errorEvaluators)+len(errorModifiers) > 0
 
 	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
-		now := timeNow().Format("2006-01-02T15:04:05.999Z07:00")
+		now := o.now()
+
+		if hasPre {
+			preCtx, span := pre.startSpan(ctx)
+			err := func() error {
+				var body map[string]interface{}
+				if readBody {
+					var err error
+					if body, err = readReqBody(r, maxBodySize); err != nil {
+						l.Info(pre.name, "Unable to read the request body:", err.Error())
+						return err
+					}
+				}
 
-		if err := evalChecks(l, name+"[pre]", newReqActivation(r, now), preEvaluators); err != nil {
-			return nil, err
+				if err := evalChecks(preCtx, pre, internal.NewReqActivation(r, now, body), preEvaluators); err != nil {
+					return err
+				}
+				return evalReqMods(preCtx, pre, r, now, body, preModifiers, backend)
+			}()
+			endSpan(span, err)
+			if err != nil {
+				return nil, o.explainError(r, err)
+			}
 		}
 
 		resp, err := next(ctx, r)
 		if err != nil {
 			l.Debug(name, "Delegated execution failed:", err.Error())
-			return resp, err
+			if !hasOnError {
+				return resp, err
+			}
+			postCtx, span := post.startSpan(ctx)
+			resp, err = func() (*proxy.Response, error) {
+				var body []byte
+				if readErrorRespBody {
+					var bodyErr error
+					if body, bodyErr = readResponseBody(post, resp, maxBodySize); bodyErr != nil {
+						return nil, bodyErr
+					}
+				}
+				if err := evalChecks(postCtx, post, internal.NewRespActivation(resp, err, now, body), errorEvaluators); err != nil {
+					return nil, err
+				}
+				return evalErrorMods(postCtx, post, resp, err, now, body, errorModifiers)
+			}()
+			endSpan(span, err)
+			return resp, o.explainError(r, err)
 		}
 
-		if err := evalChecks(l, name+"[post]", newRespActivation(resp, now), postEvaluators); err != nil {
-			return nil, err
+		if !hasPost {
+			return resp, nil
+		}
+
+		postCtx, span := post.startSpan(ctx)
+		err = func() error {
+			var body []byte
+			if readRespBody {
+				var err error
+				if body, err = readResponseBody(post, resp, maxBodySize); err != nil {
+					return err
+				}
+			}
+			if err := evalChecks(postCtx, post, internal.NewRespActivation(resp, nil, now, body), postEvaluators); err != nil {
+				return err
+			}
+			return evalRespMods(postCtx, post, resp, now, body, postModifiers)
+		}()
+		endSpan(span, err)
+		if err != nil {
+			return nil, o.explainError(r, err)
 		}
 
 		return resp, nil
 	}, nil
 }
 
-func evalChecks(l logging.Logger, name string, args map[string]interface{}, ps []cel.Program) error {
-	for i, eval := range ps {
-		res, _, err := eval.Eval(args)
+func evalChecks(ctx context.Context, obs observer, args map[string]interface{}, ps []internal.Evaluator) error {
+	for _, eval := range ps {
+		start := time.Now()
+		res, det, err := eval.ContextEval(ctx, args)
 		if err != nil {
-			l.Info(fmt.Sprintf("%s Evaluator #%d failed: %v", name, i, res))
-			return fmt.Errorf("request aborted by evaluator #%d", i)
+			if eval.Definition.IsAudit() {
+				obs.record(ctx, eval, outcomeAuditError, start, res, det)
+				obs.l.Warning(fmt.Sprintf("%s Evaluator %s failed in audit mode: %v", obs.name, eval.ID(), res))
+				obs.explain("Evaluator", eval, det)
+				continue
+			}
+			obs.record(ctx, eval, outcomeError, start, res, det)
+			obs.l.Info(fmt.Sprintf("%s Evaluator %s failed: %v", obs.name, eval.ID(), res))
+			return newRejectionError(eval, obs.explain("Evaluator", eval, det))
 		}
 
-		resultMsg := fmt.Sprintf("%s Evaluator #%d result: %v", name, i, res)
+		resultMsg := fmt.Sprintf("%s Evaluator %s result: %v", obs.name, eval.ID(), res)
 
 		if v, ok := res.Value().(bool); !ok || !v {
-			l.Info(resultMsg)
-			return fmt.Errorf("request aborted by evaluator #%d", i)
+			if eval.Definition.IsAudit() {
+				obs.record(ctx, eval, outcomeAuditReject, start, res, det)
+				obs.l.Warning(resultMsg, "(audit mode: the request is not rejected)")
+				obs.explain("Evaluator", eval, det)
+				continue
+			}
+			obs.record(ctx, eval, outcomeReject, start, res, det)
+			obs.l.Info(resultMsg)
+			return newRejectionError(eval, obs.explain("Evaluator", eval, det))
 		}
-		l.Debug(resultMsg)
+		obs.record(ctx, eval, outcomePass, start, res, det)
+		obs.l.Debug(resultMsg)
 	}
 	return nil
 }
 
-func newReqActivation(r *proxy.Request, now string) map[string]interface{} {
-	return map[string]interface{}{
-		internal.PreKey + "_method":      r.Method,
-		internal.PreKey + "_path":        r.Path,
-		internal.PreKey + "_params":      r.Params,
-		internal.PreKey + "_headers":     r.Headers,
-		internal.PreKey + "_querystring": r.Query,
-		internal.NowKey:                  now,
+// readResponseBody reads the streamed content of the response, logging the failures
+func readResponseBody(obs observer, r *proxy.Response, maxSize int64) ([]byte, error) {
+	body, err := readRespBody(r, maxSize)
+	if err != nil {
+		obs.l.Info(obs.name, "Unable to read the response body:", err.Error())
 	}
+	return body, err
 }
 
-func newRespActivation(r *proxy.Response, now string) map[string]interface{} {
-	return map[string]interface{}{
-		internal.PostKey + "_completed":        r.IsComplete,
-		internal.PostKey + "_metadata_status":  r.Metadata.StatusCode,
-		internal.PostKey + "_metadata_headers": r.Metadata.Headers,
-		internal.PostKey + "_data":             r.Data,
-		internal.NowKey:                        now,
+// newLibrary returns the constants, macros and named rules available to the definitions,
+// merging the service ones with the ones declared by the endpoint or backend
+func newLibrary(o options, cfg internal.Config) (*internal.Library, error) {
+	if o.serviceErr != nil {
+		return nil, fmt.Errorf("service config: %w", o.serviceErr)
+	}
+	if len(cfg.Constants)+len(cfg.Macros)+len(cfg.NamedRules) == 0 {
+		return o.library, nil
 	}
+	return internal.NewLibrary(o.service, cfg)
 }
 
-var timeNow = time.Now
+// referencesAny returns true if any of the evaluators references the variable
+func referencesAny(name string, evals ...[]internal.Evaluator) bool {
+	for _, es := range evals {
+		for _, e := range es {
+			if e.References(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filterOnError returns the evaluators to run when the execution fails
+func filterOnError(evals []internal.Evaluator) []internal.Evaluator {
+	var res []internal.Evaluator
+	for _, e := range evals {
+		if e.Definition.OnError {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// errorProxy returns a proxy failing all the requests with the given error. It is used when
+// a strict backend can not be built, so the pipe fails closed
+func errorProxy(err error) proxy.Proxy {
+	return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return nil, err
+	}
+}
+
+var (
+	timeNow = time.Now
+
+	errWrongConfig = errors.New("unable to decode the CEL configuration")
+	// errBackendOnlyMod is returned by the endpoint modifiers updating the path or the method,
+	// as the request builder of the backends overwrites them
+	errBackendOnlyMod = errors.New("the request path and method can only be modified at backend level")
+)
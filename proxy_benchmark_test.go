@@ -46,3 +46,42 @@ func BenchmarkProxyFactory_reqParams_int(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkProxyFactory_startup(b *testing.B) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	pf := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse))
+
+	for _, tc := range []struct {
+		name string
+		expr func(int) string
+	}{
+		{
+			name: "duplicated",
+			expr: func(_ int) string { return "int(req_params.Id) % 2 == 0 && req_headers['X-Role'][0] == 'admin'" },
+		},
+		{
+			name: "unique",
+			expr: func(i int) string {
+				return "int(req_params.Id) % 2 == 0 && req_headers['X-Role'][0] == 'admin-" + strconv.Itoa(i) + "'"
+			},
+		},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := pf.New(&config.EndpointConfig{
+					Endpoint: "/",
+					ExtraConfig: config.ExtraConfig{
+						internal.Namespace: []internal.InterpretableDefinition{
+							{CheckExpression: tc.expr(i)},
+							{CheckExpression: "resp_data.ok"},
+						},
+					},
+				}); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	}
+}
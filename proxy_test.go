@@ -3,9 +3,18 @@ package cel
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,6 +22,7 @@ import (
 	"github.com/luraproject/lura/v2/config"
 	"github.com/luraproject/lura/v2/logging"
 	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/transport/http/client"
 )
 
 func TestProxyFactory_reqQuerystring(t *testing.T) {
@@ -269,3 +279,1200 @@ func dummyProxyFactory(r *proxy.Response) proxy.Factory {
 		}, nil
 	})
 }
+
+func TestProxyFactory_modExpr(t *testing.T) {
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{
+				Data: map[string]interface{}{
+					"path":    r.Path,
+					"id":      r.Params["Id"],
+					"header":  r.Headers["X-Foo"],
+					"query":   r.Query.Get("q"),
+					"removed": true,
+				},
+				IsComplete: true,
+				Metadata: proxy.Metadata{
+					StatusCode: 200,
+					Headers:    map[string][]string{},
+				},
+			}, nil
+		}, nil
+	})
+
+	prxy, err := ProxyFactory(logging.NoOp, pf).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{ModExpression: "{'req_params': {'Id': string(int(req_params.Id) * 2)}}"},
+				{ModExpression: "{'req_headers': {'X-Foo': ['bar', req_params.Id]}, 'req_querystring': {'q': 'x'}}"},
+				{ModExpression: "{'resp_data': {'added': resp_data.id + '!', 'removed': null}, 'resp_metadata_status': 201}"},
+				{ModExpression: "{'resp_metadata_headers': {'X-Status': [string(resp_metadata_status)]}}"},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := prxy(context.Background(), &proxy.Request{
+		Method:  "GET",
+		Path:    "/some-path",
+		Params:  map[string]string{"Id": "21"},
+		Headers: map[string][]string{},
+		Query:   url.Values{},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if resp.Metadata.StatusCode != 201 {
+		t.Errorf("unexpected status code %d", resp.Metadata.StatusCode)
+	}
+	if h := resp.Metadata.Headers["X-Status"]; len(h) != 1 || h[0] != "201" {
+		t.Errorf("unexpected headers %v", resp.Metadata.Headers)
+	}
+
+	expected := map[string]interface{}{
+		"path":   "/some-path",
+		"id":     "42",
+		"header": []string{"bar", "42"},
+		"query":  "x",
+		"added":  "42!",
+	}
+	if fmt.Sprintf("%v", resp.Data) != fmt.Sprintf("%v", expected) {
+		t.Errorf("unexpected response data %v", resp.Data)
+	}
+}
+
+func TestProxyFactory_modExpr_backendOnly(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	cfg := &config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{ModExpression: "{'req_path': '/rewritten', 'req_headers': {'X-Foo': [req_path]}}"},
+			},
+		},
+	}
+
+	if _, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse), WithStrictMode(true)).New(cfg); !errors.Is(err, errBackendOnlyMod) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	var path string
+	var headers map[string][]string
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+			path, headers = r.Path, r.Headers
+			return expectedResponse, nil
+		}, nil
+	})
+	prxy, err := ProxyFactory(logging.NoOp, pf).New(cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/orig", Headers: map[string][]string{}}); err != nil {
+		t.Error(err)
+		return
+	}
+	if path != "/orig" {
+		t.Errorf("the path should not be modified at endpoint level: %s", path)
+	}
+	if h := headers["X-Foo"]; len(h) != 1 || h[0] != "/orig" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+}
+
+func TestProxyFactory_modExpr_http(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"method": r.Method, "url": r.URL.String()})
+	}))
+	defer s.Close()
+
+	for i, tc := range []struct {
+		endpoint []interface{}
+		backend  []interface{}
+		method   string
+		url      string
+	}{
+		{
+			method: "GET",
+			url:    "/items/1",
+		},
+		{
+			endpoint: []interface{}{map[string]interface{}{"mod_expr": "{'req_params': {'Id': '2'}, 'req_querystring': {'q': ['x']}}"}},
+			method:   "GET",
+			url:      "/items/2?q=x",
+		},
+		{
+			backend: []interface{}{map[string]interface{}{"mod_expr": "{'req_path': '/rewritten', 'req_method': 'POST', 'req_querystring': {'q': ['x']}}"}},
+			method:  "POST",
+			url:     "/rewritten?q=x",
+		},
+		{
+			backend: []interface{}{map[string]interface{}{"mod_expr": "{'req_params': {'Id': '3'}}"}},
+			method:  "GET",
+			url:     "/items/3",
+		},
+	} {
+		backend := map[string]interface{}{"host": []string{s.URL}, "url_pattern": "/items/{id}"}
+		if tc.backend != nil {
+			backend["extra_config"] = map[string]interface{}{internal.Namespace: tc.backend}
+		}
+		endpoint := map[string]interface{}{"endpoint": "/items/{id}", "backend": []interface{}{backend}}
+		if tc.endpoint != nil {
+			endpoint["extra_config"] = map[string]interface{}{internal.Namespace: tc.endpoint}
+		}
+		b, _ := json.Marshal(map[string]interface{}{"version": 3, "endpoints": []interface{}{endpoint}})
+		cfgPath := filepath.Join(t.TempDir(), "krakend.json")
+		if err := os.WriteFile(cfgPath, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := config.NewParser().Parse(cfgPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bf := BackendFactory(logging.NoOp, proxy.CustomHTTPProxyFactory(client.NewHTTPClient), WithStrictMode(true))
+		prxy, err := ProxyFactory(logging.NoOp, proxy.NewDefaultFactory(bf, logging.NoOp), WithStrictMode(true)).New(cfg.Endpoints[0])
+		if err != nil {
+			t.Errorf("#%d: %s", i, err)
+			continue
+		}
+
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "GET",
+			Path:    "/items/1",
+			Params:  map[string]string{"Id": "1"},
+			Headers: map[string][]string{},
+			Query:   url.Values{},
+			Body:    io.NopCloser(strings.NewReader("")),
+			URL:     new(url.URL),
+		})
+		if err != nil {
+			t.Errorf("#%d: %s", i, err)
+			continue
+		}
+		if m := resp.Data["method"]; m != tc.method {
+			t.Errorf("#%d: unexpected method %v", i, m)
+		}
+		if u := resp.Data["url"]; u != tc.url {
+			t.Errorf("#%d: unexpected url %v", i, u)
+		}
+	}
+}
+
+func TestProxyFactory_modExpr_wrongType(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{ModExpression: "req_path + '/foo'"},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := prxy(context.Background(), &proxy.Request{
+		Method:  "GET",
+		Path:    "/some-path",
+		Params:  map[string]string{},
+		Headers: map[string][]string{},
+	})
+	if err == nil {
+		t.Error("expecting error")
+	}
+	if resp != nil {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestProxyFactory_modExpr_static(t *testing.T) {
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{
+				Data:       map[string]interface{}{"api": r.Headers["X-Api"]},
+				IsComplete: true,
+				Metadata:   proxy.Metadata{StatusCode: 200, Headers: map[string][]string{}},
+			}, nil
+		}, nil
+	})
+
+	prxy, err := ProxyFactory(logging.NoOp, pf, WithStrictMode(true)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{ModExpression: "{'req_headers': {'X-Api': ['2']}}"},
+				{ModExpression: "{'resp_metadata_headers': {'X-Frame-Options': ['DENY']}}"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := prxy(context.Background(), &proxy.Request{Method: "GET", Headers: map[string][]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := resp.Metadata.Headers["X-Frame-Options"]; len(h) != 1 || h[0] != "DENY" {
+		t.Errorf("unexpected headers %v", resp.Metadata.Headers)
+	}
+	if h, ok := resp.Data["api"].([]string); !ok || len(h) != 1 || h[0] != "2" {
+		t.Errorf("unexpected response data %v", resp.Data)
+	}
+
+	for _, strict := range []bool{true, false} {
+		_, err := ProxyFactory(logging.NoOp, pf, WithStrictMode(strict)).New(&config.EndpointConfig{
+			Endpoint: "/",
+			ExtraConfig: config.ExtraConfig{
+				internal.Namespace: []internal.InterpretableDefinition{
+					{Name: "static", CheckExpression: "1 + 1 == 2"},
+				},
+			},
+		})
+		if strict != errors.Is(err, internal.ErrNoPhase) {
+			t.Errorf("strict: %v, unexpected error: %v", strict, err)
+		}
+	}
+}
+
+func TestProxyFactory_modExpr_mixedPhases(t *testing.T) {
+	expectedResponse := &proxy.Response{
+		Data:       map[string]interface{}{"ok": true},
+		IsComplete: true,
+		Metadata:   proxy.Metadata{StatusCode: 200, Headers: map[string][]string{}},
+	}
+	cfg := &config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{ModExpression: "{'resp_metadata_headers': {'X-Path': [req_path]}}"},
+			},
+		},
+	}
+
+	if _, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse), WithStrictMode(true)).New(cfg); !errors.Is(err, internal.ErrMixedPhases) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// the rule is skipped in the default mode instead of aborting all the requests
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := prxy(context.Background(), &proxy.Request{Method: "GET", Path: "/foo", Headers: map[string][]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resp.Metadata.Headers["X-Path"]; ok {
+		t.Errorf("unexpected headers %v", resp.Metadata.Headers)
+	}
+}
+
+func TestProxyFactory_rejectionError(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "req_method == 'GET'"},
+				{
+					CheckExpression: "'admin' in req_headers['X-Role']",
+					StatusCode:      403,
+					Message:         `{"error":"admin role required"}`,
+					ContentType:     "application/json",
+					Headers:         map[string][]string{"X-Denied-By": {"cel"}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = prxy(context.Background(), &proxy.Request{
+		Method:  "POST",
+		Path:    "/some-path",
+		Params:  map[string]string{},
+		Headers: map[string][]string{"X-Role": {"admin"}},
+	})
+	if err == nil || err.Error() != "request aborted by evaluator #0" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, ok := err.(RejectionError); ok {
+		t.Error("unexpected rejection error")
+	}
+
+	_, err = prxy(context.Background(), &proxy.Request{
+		Method:  "GET",
+		Path:    "/some-path",
+		Params:  map[string]string{},
+		Headers: map[string][]string{"X-Role": {"user"}},
+	})
+	rErr, ok := err.(RejectionError)
+	if !ok {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if rErr.StatusCode() != 403 {
+		t.Errorf("unexpected status code %d", rErr.StatusCode())
+	}
+	if rErr.Error() != `{"error":"admin role required"}` {
+		t.Errorf("unexpected message %s", rErr.Error())
+	}
+	if rErr.Encoding() != "application/json" {
+		t.Errorf("unexpected encoding %s", rErr.Encoding())
+	}
+	if h := rErr.Headers()["X-Denied-By"]; len(h) != 1 || h[0] != "cel" {
+		t.Errorf("unexpected headers %v", rErr.Headers())
+	}
+}
+
+func TestProxyFactory_namedRules(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "resp_completed"},
+				{CheckExpression: "req_method == 'GET'"},
+				{Name: "only-admins", CheckExpression: "'admin' in req_headers['X-Role']", StatusCode: 403},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, tc := range []struct {
+		method   string
+		role     string
+		expected string
+	}{
+		{method: "POST", role: "admin", expected: "request aborted by evaluator #1"},
+		{method: "GET", role: "user", expected: "request aborted by evaluator only-admins"},
+	} {
+		_, err = prxy(context.Background(), &proxy.Request{
+			Method:  tc.method,
+			Path:    "/some-path",
+			Params:  map[string]string{},
+			Headers: map[string][]string{"X-Role": {tc.role}},
+		})
+		if err == nil || err.Error() != tc.expected {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestProxyFactory_phases(t *testing.T) {
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{Data: map[string]interface{}{"status": r.Params["Status"]}, IsComplete: true}, nil
+		}, nil
+	})
+
+	prxy, err := ProxyFactory(logging.NoOp, pf).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []interface{}{
+				map[string]interface{}{"check_expr": "resp_data.status == 'required'"},
+				map[string]interface{}{"check_expr": "now_str != ''", "phase": []string{"pre", "post"}},
+				map[string]interface{}{"check_expr": "req_params.Status == 'never'", "phase": "jwt"},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, tc := range []struct {
+		status  string
+		success bool
+	}{
+		{status: "required", success: true},
+		{status: "other", success: false},
+	} {
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "GET",
+			Path:    "/some-path",
+			Params:  map[string]string{"Status": tc.status},
+			Headers: map[string][]string{},
+		})
+		if tc.success != (err == nil) {
+			t.Errorf("%s: unexpected error: %v", tc.status, err)
+		}
+		if tc.success != (resp != nil) {
+			t.Errorf("%s: unexpected response: %v", tc.status, resp)
+		}
+	}
+}
+
+func TestProxyFactory_unknownPhase(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []interface{}{
+				map[string]interface{}{"check_expr": "req_method == 'POST'", "phase": "before"},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := prxy(context.Background(), &proxy.Request{Method: "GET"})
+	if err != nil {
+		t.Error(err)
+	}
+	if resp != expectedResponse {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestProxyFactory_invalidStatusCode(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+
+	for _, code := range []int{42, 1000, -1} {
+		cfg := &config.EndpointConfig{
+			Endpoint: "/",
+			ExtraConfig: config.ExtraConfig{
+				internal.Namespace: []interface{}{
+					map[string]interface{}{"check_expr": "req_method == 'POST'", "status_code": code},
+				},
+			},
+		}
+
+		var codeErr internal.ErrInvalidStatusCode
+		if _, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse), WithStrictMode(true)).New(cfg); !errors.As(err, &codeErr) {
+			t.Errorf("%d: unexpected error: %v", code, err)
+		}
+
+		// the invalid definitions are skipped in the default mode, so the status code never reaches the router
+		prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(cfg)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", code, err)
+			continue
+		}
+		if resp, err := prxy(context.Background(), &proxy.Request{Method: "GET"}); err != nil || resp != expectedResponse {
+			t.Errorf("%d: unexpected response %+v, %v", code, resp, err)
+		}
+	}
+}
+
+func TestProxyFactory_strict(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	wrongType := map[string]interface{}{"check_expr": "req_method == 42"}
+
+	for _, tc := range []struct {
+		name    string
+		extra   interface{}
+		opts    []Option
+		success bool
+	}{
+		{
+			name:    "default",
+			extra:   []interface{}{wrongType},
+			success: true,
+		},
+		{
+			name:  "global",
+			extra: []interface{}{wrongType},
+			opts:  []Option{WithStrictMode(true)},
+		},
+		{
+			name:  "endpoint",
+			extra: map[string]interface{}{"strict": true, "rules": []interface{}{wrongType}},
+		},
+		{
+			name:    "endpoint override",
+			extra:   map[string]interface{}{"strict": false, "rules": []interface{}{wrongType}},
+			opts:    []Option{WithStrictMode(true)},
+			success: true,
+		},
+		{
+			name:  "wrong config",
+			extra: map[string]interface{}{"rules": "req_method == 'GET'"},
+			opts:  []Option{WithStrictMode(true)},
+		},
+	} {
+		_, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse), tc.opts...).New(&config.EndpointConfig{
+			Endpoint:    "/",
+			ExtraConfig: config.ExtraConfig{internal.Namespace: tc.extra},
+		})
+		if tc.success != (err == nil) {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+}
+
+func TestBackendFactory_strict(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	bf := func(_ *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return expectedResponse, nil
+		}
+	}
+
+	l := &fatalLogger{Logger: logging.NoOp}
+	prxy := BackendFactory(l, bf, WithStrictMode(true))(&config.Backend{
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "req_method == 42"},
+			},
+		},
+	})
+
+	if !l.fatal {
+		t.Error("the backend factory should stop the gateway")
+	}
+
+	resp, err := prxy(context.Background(), &proxy.Request{Method: "GET"})
+	if err == nil {
+		t.Error("expecting error")
+	}
+	if resp != nil {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+// fatalLogger records the calls to Fatal instead of exiting the process
+type fatalLogger struct {
+	logging.Logger
+	fatal bool
+}
+
+func (l *fatalLogger) Fatal(_ ...interface{}) {
+	l.fatal = true
+}
+
+func TestProxyFactory_onError(t *testing.T) {
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+			code, _ := strconv.Atoi(r.Params["Code"])
+			if code == 0 {
+				return nil, errors.New("wrapped error")
+			}
+			return nil, client.HTTPResponseError{Code: code, Msg: `{"secret":"details"}`, Enc: "application/json"}
+		}, nil
+	})
+
+	prxy, err := ProxyFactory(logging.NoOp, pf).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []interface{}{
+				map[string]interface{}{"check_expr": "resp_completed"},
+				map[string]interface{}{"check_expr": "resp_error_status != 401", "on_error": true, "status_code": 403},
+				map[string]interface{}{
+					"mod_expr": "resp_error_status == 404 ? {'resp_error': null, 'resp_data': {'items': []}, 'resp_completed': true} : {}",
+					"on_error": true,
+				},
+				map[string]interface{}{
+					"mod_expr": "resp_error_status >= 500 ? {'resp_error': 'upstream failure', 'resp_error_status': 502} : {}",
+					"on_error": true,
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, tc := range []struct {
+		code   string
+		status int
+		msg    string
+	}{
+		{code: "404"},
+		{code: "401", status: 403, msg: "request aborted by evaluator #1"},
+		{code: "503", status: 502, msg: "upstream failure"},
+		{code: "400", status: 400, msg: `{"secret":"details"}`},
+		{code: "0", msg: "wrapped error"},
+	} {
+		resp, err := prxy(context.Background(), &proxy.Request{
+			Method:  "GET",
+			Path:    "/some-path",
+			Params:  map[string]string{"Code": tc.code},
+			Headers: map[string][]string{},
+		})
+		if tc.msg == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tc.code, err)
+				continue
+			}
+			if !resp.IsComplete || fmt.Sprintf("%v", resp.Data) != "map[items:[]]" {
+				t.Errorf("%s: unexpected response %+v", tc.code, resp)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tc.msg {
+			t.Errorf("%s: unexpected error %v", tc.code, err)
+			continue
+		}
+		if code := internal.ErrorStatusCode(err); code != tc.status {
+			t.Errorf("%s: unexpected status code %d", tc.code, code)
+		}
+	}
+}
+
+func TestProxyFactory_costLimit(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	costly := "req_headers.all(k, req_headers[k].all(v, v.startsWith('x')))"
+
+	for _, tc := range []struct {
+		name    string
+		extra   interface{}
+		opts    []Option
+		success bool
+	}{
+		{
+			name:    "no limit",
+			extra:   []interface{}{map[string]interface{}{"check_expr": costly}},
+			opts:    []Option{WithStrictMode(true)},
+			success: true,
+		},
+		{
+			name:  "global",
+			extra: []interface{}{map[string]interface{}{"check_expr": costly}},
+			opts:  []Option{WithStrictMode(true), WithCostLimit(100)},
+		},
+		{
+			name:  "rule",
+			extra: []interface{}{map[string]interface{}{"check_expr": costly, "cost_limit": 100}},
+			opts:  []Option{WithStrictMode(true)},
+		},
+		{
+			name:    "rule override",
+			extra:   []interface{}{map[string]interface{}{"check_expr": costly, "cost_limit": 100000000}},
+			opts:    []Option{WithStrictMode(true), WithCostLimit(100)},
+			success: true,
+		},
+		{
+			name:    "cheap",
+			extra:   []interface{}{map[string]interface{}{"check_expr": "req_method == 'GET'"}},
+			opts:    []Option{WithStrictMode(true), WithCostLimit(100)},
+			success: true,
+		},
+	} {
+		_, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse), tc.opts...).New(&config.EndpointConfig{
+			Endpoint:    "/",
+			ExtraConfig: config.ExtraConfig{internal.Namespace: tc.extra},
+		})
+		if tc.success != (err == nil) {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+		var costErr internal.ErrCostLimit
+		if err != nil && !errors.As(err, &costErr) {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+}
+
+func TestProxyFactory_cancelledContext(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []interface{}{
+				map[string]interface{}{"check_expr": "req_headers['X-Foo'].all(v, v != '')"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := make([]string, 2*internal.InterruptCheckFrequency)
+	for i := range values {
+		values[i] = "foo"
+	}
+	r := &proxy.Request{Method: "GET", Headers: map[string][]string{"X-Foo": values}}
+
+	if _, err := prxy(context.Background(), r); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := prxy(ctx, r); err == nil {
+		t.Error("expecting error")
+	}
+}
+
+func TestProxyFactory_audit(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{Name: "audited", CheckExpression: "int(req_params.Id) < 10", Mode: internal.AuditMode},
+				{CheckExpression: "req_method == 'GET'"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		r       *proxy.Request
+		success bool
+	}{
+		{r: &proxy.Request{Method: "GET", Params: map[string]string{"Id": "1"}}, success: true},
+		{r: &proxy.Request{Method: "GET", Params: map[string]string{"Id": "42"}}, success: true},
+		{r: &proxy.Request{Method: "GET", Params: map[string]string{"Id": "foo"}}, success: true},
+		{r: &proxy.Request{Method: "POST", Params: map[string]string{"Id": "1"}}},
+	} {
+		resp, err := prxy(context.Background(), tc.r)
+		if tc.success != (err == nil) {
+			t.Errorf("%+v: unexpected error: %v", tc.r, err)
+		}
+		if tc.success && resp != expectedResponse {
+			t.Errorf("%+v: unexpected response: %+v", tc.r, resp)
+		}
+	}
+
+	_, err = ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse), WithStrictMode(true)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "req_method == 'GET'", Mode: "dry-run"},
+			},
+		},
+	})
+	if err == nil {
+		t.Error("expecting error")
+	}
+}
+
+func TestProxyFactory_groups(t *testing.T) {
+	var extra interface{}
+	if err := json.Unmarshal([]byte(`{
+		"strict": true,
+		"named_rules": {
+			"admin": {"check_expr": "req_headers['X-Role'][0] == 'admin'"},
+			"owner": {"check_expr": "req_headers['X-User'][0] == req_params.User"},
+			"reader": {"check_expr": "req_method == 'GET'"}
+		},
+		"rules": [
+			{"name": "admin-or-owner-reading", "any": ["admin", {"all": ["owner", "reader"]}]},
+			{"name": "not-deleted", "not": {"check_expr": "req_path.endsWith('/deleted')"}}
+		]
+	}`), &extra); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse)).New(&config.EndpointConfig{
+		Endpoint:    "/",
+		ExtraConfig: config.ExtraConfig{internal.Namespace: extra},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		method  string
+		path    string
+		headers map[string][]string
+		success bool
+	}{
+		{method: "DELETE", path: "/foo", headers: map[string][]string{"X-Role": {"admin"}}, success: true},
+		{method: "GET", path: "/foo", headers: map[string][]string{"X-User": {"bob"}}, success: true},
+		{method: "DELETE", path: "/foo", headers: map[string][]string{"X-User": {"bob"}}},
+		{method: "GET", path: "/foo", headers: map[string][]string{"X-User": {"alice"}}},
+		{method: "GET", path: "/foo/deleted", headers: map[string][]string{"X-Role": {"admin"}}},
+		{method: "GET", path: "/foo"},
+	} {
+		_, err := prxy(context.Background(), &proxy.Request{
+			Method:  tc.method,
+			Path:    tc.path,
+			Headers: tc.headers,
+			Params:  map[string]string{"User": "bob"},
+		})
+		if tc.success != (err == nil) {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestProxyFactory_wrongGroups(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	for _, tc := range []struct {
+		name  string
+		extra string
+	}{
+		{name: "unknown rule", extra: `{"rules": [{"any": ["foo"]}]}`},
+		{name: "cycle", extra: `{"named_rules": {"a": {"any": ["b"]}, "b": {"not": "a"}}, "rules": [{"all": ["a"]}]}`},
+		{name: "several operators", extra: `{"rules": [{"any": [{"check_expr": "req_method == 'GET'"}], "not": {"check_expr": "true"}}]}`},
+		{name: "empty", extra: `{"rules": [{"all": []}]}`},
+		{name: "expression", extra: `{"rules": [{"check_expr": "req_method == 'GET'", "not": {"check_expr": "req_path == '/'"}}]}`},
+		{name: "not bool", extra: `{"rules": [{"any": [{"check_expr": "req_method"}]}]}`},
+	} {
+		var extra interface{}
+		if err := json.Unmarshal([]byte(tc.extra), &extra); err != nil {
+			t.Fatal(err)
+		}
+		_, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse), WithStrictMode(true)).New(&config.EndpointConfig{
+			Endpoint:    "/",
+			ExtraConfig: config.ExtraConfig{internal.Namespace: extra},
+		})
+		if err == nil {
+			t.Errorf("%s: expecting error", tc.name)
+		}
+	}
+}
+
+func TestProxyFactory_library(t *testing.T) {
+	var service config.ExtraConfig
+	if err := json.Unmarshal([]byte(`{"github.com/devopsfaith/krakend-cel": {
+		"constants": {"max_id": 10, "methods": ["GET", "HEAD"]},
+		"macros": {
+			"valid_id": "int(req_params.Id) > 0 && int(req_params.Id) <= max_id",
+			"safe_method": "req_method in methods",
+			"readable": "safe_method && valid_id"
+		},
+		"named_rules": {"reader": {"check_expr": "readable"}}
+	}}`), &service); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	pf := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse), WithStrictMode(true), WithServiceConfig(service))
+
+	for _, tc := range []struct {
+		name  string
+		extra string
+		cases map[string]bool
+	}{
+		{
+			name:  "macro",
+			extra: `[{"check_expr": "readable"}]`,
+			cases: map[string]bool{"GET 1": true, "HEAD 10": true, "GET 11": false, "POST 1": false},
+		},
+		{
+			name:  "named rule",
+			extra: `{"rules": [{"not": "reader"}]}`,
+			cases: map[string]bool{"GET 1": false, "POST 1": true},
+		},
+		{
+			name:  "endpoint override",
+			extra: `{"constants": {"max_id": 100}, "rules": [{"check_expr": "valid_id"}]}`,
+			cases: map[string]bool{"GET 11": true, "GET 101": false},
+		},
+		{
+			name:  "endpoint macro",
+			extra: `{"macros": {"post_or_safe": "req_method == 'POST' || safe_method"}, "rules": [{"check_expr": "post_or_safe"}]}`,
+			cases: map[string]bool{"POST 1": true, "PUT 1": false},
+		},
+	} {
+		var extra interface{}
+		if err := json.Unmarshal([]byte(tc.extra), &extra); err != nil {
+			t.Fatal(err)
+		}
+		prxy, err := pf.New(&config.EndpointConfig{
+			Endpoint:    "/",
+			ExtraConfig: config.ExtraConfig{internal.Namespace: extra},
+		})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		for req, success := range tc.cases {
+			parts := strings.Split(req, " ")
+			_, err := prxy(context.Background(), &proxy.Request{Method: parts[0], Params: map[string]string{"Id": parts[1]}})
+			if success != (err == nil) {
+				t.Errorf("%s: %s: unexpected error: %v", tc.name, req, err)
+			}
+		}
+	}
+}
+
+func TestProxyFactory_wrongLibrary(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	for _, tc := range []struct {
+		name  string
+		extra string
+		err   error
+	}{
+		{name: "cycle", extra: `{"macros": {"a": "b && true", "b": "!c", "c": "a"}}`, err: internal.ErrMacroCycle("a")},
+		{name: "self reference", extra: `{"macros": {"a": "a"}}`, err: internal.ErrMacroCycle("a")},
+		{name: "shadowed variable", extra: `{"constants": {"req_method": "GET"}}`, err: internal.ErrDuplicatedName("req_method")},
+		{name: "duplicated name", extra: `{"constants": {"a": 1}, "macros": {"a": "true"}}`, err: internal.ErrDuplicatedName("a")},
+		{name: "wrong macro", extra: `{"macros": {"a": "req_method == 1"}}`},
+	} {
+		var extra interface{}
+		if err := json.Unmarshal([]byte(tc.extra), &extra); err != nil {
+			t.Fatal(err)
+		}
+		service := config.ExtraConfig{internal.Namespace: extra}
+		_, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse), WithStrictMode(true), WithServiceConfig(service)).New(&config.EndpointConfig{
+			Endpoint:    "/",
+			ExtraConfig: config.ExtraConfig{internal.Namespace: []interface{}{map[string]interface{}{"check_expr": "true"}}},
+		})
+		if err == nil {
+			t.Errorf("%s: expecting error", tc.name)
+			continue
+		}
+		if tc.err != nil && !errors.Is(err, tc.err) {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+}
+
+func TestProxyFactory_gatewayFunctions(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	r := &proxy.Request{
+		Method: "GET",
+		Path:   "/v1.2/users",
+		Headers: map[string][]string{
+			"X-Forwarded-For": {"192.168.1.10, 10.0.0.1"},
+			"Authorization":   {"Basic dXNlcjpzZWNyZXQ="},
+			"X-Api-Key":       {"foo"},
+			"X-Pattern":       {"^/v(\\d+)"},
+			"X-Wrong-Pattern": {"("},
+		},
+	}
+
+	for _, tc := range []struct {
+		expr    string
+		success bool
+	}{
+		{expr: "ip(header(req_headers, 'x-forwarded-for').split(',')[0].trim()).inCidr('192.168.0.0/16')", success: true},
+		{expr: "ip(header(req_headers, 'X-FORWARDED-FOR').split(',')[1].trim()).inCidr('192.168.0.0/16')"},
+		{expr: "req_method == 'GET' && ip('::ffff:10.1.2.3').inCidr('10.0.0.0/8') && string(ip('::ffff:10.1.2.3')) == '10.1.2.3'", success: true},
+		{expr: "req_method == 'GET' && isIP('10.0.0.1') && !isIP('foo') && ip('2001:db8::1').inCidr('2001:db8::/32')", success: true},
+		{expr: "req_method == 'GET' && ip('foo').inCidr('10.0.0.0/8')"},
+		{expr: "req_method == 'GET' && ip('10.0.0.1').inCidr('foo')"},
+		{expr: "header(req_headers, 'X-Missing') == '' && header(req_headers, 'x-api-key') == 'foo'", success: true},
+		{expr: "sha256(header(req_headers, 'X-Api-Key')) == '2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae'", success: true},
+		{expr: "string(base64.decode(header(req_headers, 'Authorization').substring(6))) == 'user:secret'", success: true},
+		{expr: "req_path.captures('^/v(\\\\d+)\\\\.(\\\\d+)/') == ['1', '2'] && req_path.captures('^/v3') == []", success: true},
+		{expr: "regex.extract(req_path, '/(\\\\w+)$') == optional.of('users')", success: true},
+		{expr: "req_path.captures(header(req_headers, 'X-Pattern')) == ['1']", success: true},
+		{expr: "req_path.captures(header(req_headers, 'X-Wrong-Pattern')) == []"},
+	} {
+		prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse), WithStrictMode(true)).New(&config.EndpointConfig{
+			Endpoint: "/",
+			ExtraConfig: config.ExtraConfig{
+				internal.Namespace: []internal.InterpretableDefinition{{CheckExpression: tc.expr}},
+			},
+		})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.expr, err)
+			continue
+		}
+		if _, err := prxy(context.Background(), r); tc.success != (err == nil) {
+			t.Errorf("%s: unexpected error: %v", tc.expr, err)
+		}
+	}
+
+	// the literal patterns are compiled when loading the rules
+	if _, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse), WithStrictMode(true)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{{CheckExpression: "req_path.captures('(') == []"}},
+		},
+	}); err == nil {
+		t.Error("expecting an error compiling the literal pattern")
+	}
+}
+
+func TestProxyFactory_caseInsensitiveHeaders(t *testing.T) {
+	expectedResponse := &proxy.Response{
+		Data:       map[string]interface{}{"ok": true},
+		IsComplete: true,
+		Metadata:   proxy.Metadata{Headers: map[string][]string{"content-type": {"application/json"}}},
+	}
+	r := &proxy.Request{
+		Method:  "GET",
+		Headers: map[string][]string{"X-Forwarded-For": {"10.0.0.1"}, "Host": {"example.com"}},
+	}
+
+	for _, tc := range []struct {
+		expr    string
+		success bool
+	}{
+		{expr: "req_headers['x-forwarded-for'][0] == '10.0.0.1'", success: true},
+		{expr: "has(req_headers.host) && req_headers.HOST[0] == 'example.com'", success: true},
+		{expr: "req_headers['X-FORWARDED-FOR'][0] == '10.0.0.1'", success: true},
+		{expr: "'x-forwarded-for' in req_headers && !('x-real-ip' in req_headers)", success: true},
+		{expr: "req_headers.exists(k, k == 'X-Forwarded-For') && size(req_headers) == 2", success: true},
+		{expr: "req_headers['X-Real-Ip'][0] == '10.0.0.1'"},
+		{expr: "resp_metadata_headers['Content-Type'][0] == 'application/json'", success: true},
+		{expr: "has(resp_metadata_headers.CONTENT_TYPE)"},
+		{expr: "'CONTENT-TYPE' in resp_metadata_headers", success: true},
+	} {
+		prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse), WithStrictMode(true)).New(&config.EndpointConfig{
+			Endpoint: "/",
+			ExtraConfig: config.ExtraConfig{
+				internal.Namespace: []internal.InterpretableDefinition{{CheckExpression: tc.expr}},
+			},
+		})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.expr, err)
+			continue
+		}
+		if _, err := prxy(context.Background(), r); tc.success != (err == nil) {
+			t.Errorf("%s: unexpected error: %v", tc.expr, err)
+		}
+	}
+}
+
+func TestProxyFactory_policyFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"policies/admin.cel": `// only the admins can delete
+req_method != 'DELETE' ||
+	req_headers['X-Role'][0] == 'admin' // the role is set by the auth service
+`,
+		"policies/tag.cel":           `{'req_headers': {'X-Policy': ['checked', req_method]}}`,
+		"bundles/common.yaml":        "macros:\n  is_read: req_method in ['GET', 'HEAD']\nnamed_rules:\n  reader:\n    check_file: reader.cel\nrules:\n  - name: no-tracking\n    check_expr: \"!('X-Tracking' in req_headers)\"\n",
+		"bundles/reader.cel":         "is_read",
+		"bundles/nested.json":        `{"bundles": ["common.yaml"]}`,
+		"policies/empty.cel":         "  \n",
+		"policies/wrong.cel":         "req_method ==",
+		"policies/not_a_bundle.yaml": "rules: [",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{Data: map[string]interface{}{"policy": r.Headers["X-Policy"]}, IsComplete: true}, nil
+		}, nil
+	})
+
+	var extra interface{}
+	if err := json.Unmarshal([]byte(`{
+		"bundles": ["bundles/common.yaml"],
+		"rules": [
+			{"name": "admin", "check_file": "policies/admin.cel"},
+			{"name": "tag", "mod_file": "policies/tag.cel"},
+			{"name": "readers", "any": ["reader", {"check_expr": "req_headers['X-Role'][0] == 'admin'"}]}
+		]
+	}`), &extra); err != nil {
+		t.Fatal(err)
+	}
+	prxy, err := ProxyFactory(logging.NoOp, pf, WithStrictMode(true), WithConfigDir(dir)).New(&config.EndpointConfig{
+		Endpoint:    "/",
+		ExtraConfig: config.ExtraConfig{internal.Namespace: extra},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		method  string
+		headers map[string][]string
+		success bool
+	}{
+		{method: "GET", headers: map[string][]string{}, success: true},
+		{method: "DELETE", headers: map[string][]string{"X-Role": {"admin"}}, success: true},
+		{method: "DELETE", headers: map[string][]string{"X-Role": {"user"}}},
+		{method: "POST", headers: map[string][]string{"X-Role": {"user"}}},
+		{method: "GET", headers: map[string][]string{"X-Tracking": {"1"}}},
+	} {
+		resp, err := prxy(context.Background(), &proxy.Request{Method: tc.method, Headers: tc.headers})
+		if tc.success != (err == nil) {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if tc.success && !reflect.DeepEqual(resp.Data["policy"], []string{"checked", tc.method}) {
+			t.Errorf("#%d: the mod_file was not applied: %v", i, resp.Data)
+		}
+	}
+
+	for _, tc := range []string{
+		`[{"check_file": "policies/missing.cel"}]`,
+		`[{"check_file": "policies/empty.cel"}]`,
+		`[{"check_file": "policies/wrong.cel"}]`,
+		`[{"check_file": "policies/admin.cel", "check_expr": "true"}]`,
+		`{"bundles": ["bundles/nested.json"]}`,
+		`{"bundles": ["policies/not_a_bundle.yaml"]}`,
+	} {
+		var extra interface{}
+		if err := json.Unmarshal([]byte(tc), &extra); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ProxyFactory(logging.NoOp, pf, WithStrictMode(true), WithConfigDir(dir)).New(&config.EndpointConfig{
+			Endpoint:    "/",
+			ExtraConfig: config.ExtraConfig{internal.Namespace: extra},
+		}); err == nil {
+			t.Errorf("%s: expecting error", tc)
+		}
+	}
+}
+
+func TestProxyFactory_clock(t *testing.T) {
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	prxy, err := ProxyFactory(logging.NoOp, proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return proxy.NoopProxy, nil
+	}), WithStrictMode(true), WithClock(func() time.Time { return now })).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "now_str == '2030-01-01T00:00:00Z'", Phase: internal.Phases{internal.PrePhase}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := prxy(context.Background(), &proxy.Request{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	now = now.Add(time.Second)
+	if _, err := prxy(context.Background(), &proxy.Request{}); err == nil {
+		t.Error("expecting error")
+	}
+}
+
+func TestProxyFactory_defaultConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "get.cel"), []byte("req_method == 'GET'"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+
+	prxy, err := ProxyFactory(logging.NoOp, proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return proxy.NoopProxy, nil
+	}), WithStrictMode(true)).New(&config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []interface{}{map[string]interface{}{"check_file": "get.cel"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := prxy(context.Background(), &proxy.Request{Method: "POST"}); err == nil {
+		t.Error("expecting error")
+	}
+}
@@ -1,60 +1,167 @@
 package cel
 
 import (
+	"context"
 	"fmt"
+	"sync/atomic"
+	"time"
 
-	"github.com/google/cel-go/cel"
 	"github.com/krakend/krakend-cel/v2/internal"
 	"github.com/luraproject/lura/v2/config"
 	"github.com/luraproject/lura/v2/logging"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func NewRejecter(l logging.Logger, cfg *config.EndpointConfig) *Rejecter {
+// NewRejecter returns a Rejecter evaluating the definitions of the endpoint referencing the
+// JWT claims. Without a rule source, it returns nil if the endpoint has no config for the module
+// or, out of the strict mode, if the definitions are not valid. A config without JWT definitions
+// returns a Rejecter accepting all the requests
+func NewRejecter(l logging.Logger, cfg *config.EndpointConfig, opts ...Option) *Rejecter {
+	return NewClaimsRejecter(l, cfg, internal.JwtKey, opts...)
+}
+
+// NewClaimsRejecter returns a Rejecter evaluating the definitions of the endpoint against the
+// identity data of any authentication module (API keys, client certificates...), exposed
+// with the given variable name. The definitions must reference the variable or declare the
+// claims phase. As NewRejecter, it returns nil if the endpoint has no config for the module or,
+// out of the strict mode, if the definitions are not valid, unless a rule source is set, as the
+// rejecter must be registered to receive the rules of the source
+func NewClaimsRejecter(l logging.Logger, cfg *config.EndpointConfig, variable string, opts ...Option) *Rejecter {
+	o := newOptions(opts)
 	logPrefix := "[ENDPOINT: " + cfg.Endpoint + "][CEL]"
-	def, ok := internal.ConfigGetter(cfg.ExtraConfig)
-	if !ok {
-		return nil
+	phase := internal.ClaimsPhase
+	if variable == internal.JwtKey {
+		phase = internal.JwtPhase
 	}
+	obs := newObserver(l, logPrefix, newMetrics(l, o.meter), newTracer(o.tracer),
+		attribute.String("krakend.endpoint", cfg.Endpoint),
+		attribute.String("krakend.cel.phase", phase),
+	)
 
-	p := internal.NewCheckExpressionParser(l)
-	evaluators, err := p.ParseJWT(def)
-	if err != nil {
-		l.Debug(logPrefix, "Error building the JWT rejecter:", err.Error())
-		return nil
+	var initial *rejecterRules
+	if def, ok := internal.ConfigGetter(cfg.ExtraConfig); !ok {
+		if _, found := cfg.ExtraConfig[internal.Namespace]; found && o.strict {
+			l.Fatal(logPrefix, "Error building the", variable, "rejecter:", errWrongConfig.Error())
+			initial = &rejecterRules{rejectAll: true}
+		}
+	} else if evaluators, err := newClaimsEvaluators(l, def, variable, o); err != nil {
+		if def.IsStrict(o.strict) {
+			// the rejecter can not return errors, so the gateway is stopped and, if
+			// the logger does not exit, all the requests are rejected
+			l.Fatal(logPrefix, "Error building the", variable, "rejecter:", err.Error())
+			initial = &rejecterRules{rejectAll: true}
+		} else {
+			l.Debug(logPrefix, "Error building the", variable, "rejecter:", err.Error())
+		}
+	} else {
+		initial = &rejecterRules{evaluators: evaluators}
 	}
 
-	return &Rejecter{
-		name:       logPrefix,
-		evaluators: evaluators,
-		logger:     l,
+	if initial == nil {
+		if o.source == nil {
+			return nil
+		}
+		initial = &rejecterRules{}
+	}
+	r := &Rejecter{obs: obs, variable: variable, now: o.now}
+	r.rules.Store(initial)
+
+	if o.source != nil {
+		// the rules of the source are always compiled in strict mode, as the ones of the proxies
+		o.source.register(EndpointKey(cfg), func(rules interface{}) (func(), error) {
+			next := initial
+			if rules != nil {
+				def, ok := internal.ConfigGetter(config.ExtraConfig{internal.Namespace: rules})
+				if !ok {
+					return nil, errWrongConfig
+				}
+				strict := true
+				def.Strict = &strict
+				evaluators, err := newClaimsEvaluators(l, def, variable, o)
+				if err != nil {
+					return nil, err
+				}
+				next = &rejecterRules{evaluators: evaluators}
+			}
+			return func() { r.rules.Store(next) }, nil
+		})
 	}
+	return r
+}
+
+// newClaimsEvaluators compiles the definitions of the config evaluated by the rejecter of the
+// claims variable
+func newClaimsEvaluators(l logging.Logger, def internal.Config, variable string, o options) ([]internal.Evaluator, error) {
+	def, err := def.Resolve(o.configDir)
+	if err != nil {
+		return nil, err
+	}
+	lib, err := newLibrary(o, def)
+	if err != nil {
+		return nil, err
+	}
+	p := internal.NewCheckExpressionParser(l).WithStrict(def.IsStrict(o.strict)).WithClaims(variable).WithCostLimit(o.costLimit).
+		WithLibrary(lib).WithExplain(o.explain).WithClaimsVariables(o.claimsVars...)
+	return p.ParseClaims(def.Definitions)
 }
 
 type Rejecter struct {
-	name       string
-	evaluators []cel.Program
-	logger     logging.Logger
+	obs      observer
+	variable string
+	now      func() time.Time
+	rules    atomic.Pointer[rejecterRules]
+}
+
+// rejecterRules are the evaluators of a rejecter, swapped when the rules are reloaded
+type rejecterRules struct {
+	evaluators []internal.Evaluator
+	rejectAll  bool
 }
 
 func (r *Rejecter) Reject(data map[string]interface{}) bool {
-	now := timeNow().Format("2006-01-02T15:04:05.999Z07:00")
+	rules := r.rules.Load()
+	if rules.rejectAll {
+		r.obs.l.Info(r.obs.name, "Rejecting the request: invalid definitions")
+		return true
+	}
+	ctx := context.Background()
+	now := r.now()
 	reqActivation := map[string]interface{}{
-		internal.JwtKey: data,
-		internal.NowKey: now,
+		r.variable:         data,
+		internal.NowKey:    now,
+		internal.NowStrKey: internal.FormatNow(now),
 	}
-	for i, eval := range r.evaluators {
-		res, _, err := eval.Eval(reqActivation)
+	for _, eval := range rules.evaluators {
+		start := time.Now()
+		res, det, err := eval.ContextEval(ctx, reqActivation)
 		if err != nil {
-			r.logger.Info(fmt.Sprintf("%s Rejecter #%d failed: %v", r.name, i, res))
+			if eval.Definition.IsAudit() {
+				r.obs.record(ctx, eval, outcomeAuditError, start, res, det)
+				r.obs.l.Warning(fmt.Sprintf("%s Rejecter %s failed in audit mode: %v", r.obs.name, eval.ID(), res))
+				r.obs.explain("Rejecter", eval, det)
+				continue
+			}
+			r.obs.record(ctx, eval, outcomeError, start, res, det)
+			r.obs.l.Info(fmt.Sprintf("%s Rejecter %s failed: %v", r.obs.name, eval.ID(), res))
+			r.obs.explain("Rejecter", eval, det)
 			return true
 		}
 
-		resultMsg := fmt.Sprintf("%s Rejecter #%d result: %v", r.name, i, res)
+		resultMsg := fmt.Sprintf("%s Rejecter %s result: %v", r.obs.name, eval.ID(), res)
 		if v, ok := res.Value().(bool); !ok || !v {
-			r.logger.Info(resultMsg)
+			if eval.Definition.IsAudit() {
+				r.obs.record(ctx, eval, outcomeAuditReject, start, res, det)
+				r.obs.l.Warning(resultMsg, "(audit mode: the request is not rejected)")
+				r.obs.explain("Rejecter", eval, det)
+				continue
+			}
+			r.obs.record(ctx, eval, outcomeReject, start, res, det)
+			r.obs.l.Info(resultMsg)
+			r.obs.explain("Rejecter", eval, det)
 			return true
 		}
-		r.logger.Debug(resultMsg)
+		r.obs.record(ctx, eval, outcomePass, start, res, det)
+		r.obs.l.Debug(resultMsg)
 	}
 	return false
 }
@@ -2,6 +2,7 @@ package cel
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -9,6 +10,7 @@ import (
 	"github.com/krakend/krakend-cel/v2/internal"
 	"github.com/luraproject/lura/v2/config"
 	"github.com/luraproject/lura/v2/logging"
+	"github.com/luraproject/lura/v2/proxy"
 )
 
 func TestRejecter_Reject(t *testing.T) {
@@ -77,3 +79,234 @@ func TestRejecter_Reject(t *testing.T) {
 		}
 	}
 }
+
+func TestNewRejecter_strict(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "JWT.user_id == 42 && now == 1"},
+			},
+		},
+	}
+
+	if rejecter := NewRejecter(logging.NoOp, cfg); rejecter == nil || rejecter.Reject(map[string]interface{}{"user_id": 42}) {
+		t.Error("the invalid definition should be ignored")
+	}
+
+	l := &fatalLogger{Logger: logging.NoOp}
+	rejecter := NewRejecter(l, cfg, WithStrictMode(true))
+	if !l.fatal {
+		t.Error("the rejecter should stop the gateway")
+	}
+	if rejecter == nil {
+		t.Error("nil rejecter")
+		return
+	}
+	if !rejecter.Reject(map[string]interface{}{"user_id": 42}) {
+		t.Error("the strict rejecter should reject all the requests")
+	}
+}
+
+func TestNewClaimsRejecter(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []interface{}{
+				map[string]interface{}{"check_expr": "req_method == 'GET'"},
+				map[string]interface{}{"check_expr": "has(JWT.sub)"},
+				map[string]interface{}{"check_expr": "'admin' in apikey.roles"},
+				map[string]interface{}{"check_expr": "now_str != ''", "phase": "claims"},
+			},
+		},
+	}
+
+	rejecter := NewClaimsRejecter(logging.NoOp, cfg, "apikey")
+	if rejecter == nil {
+		t.Error("nil rejecter")
+		return
+	}
+	if len(rejecter.rules.Load().evaluators) != 2 {
+		t.Errorf("unexpected number of evaluators: %d", len(rejecter.rules.Load().evaluators))
+	}
+
+	for _, tc := range []struct {
+		data     map[string]interface{}
+		expected bool
+	}{
+		{data: map[string]interface{}{}, expected: true},
+		{data: map[string]interface{}{"roles": []string{"user"}}, expected: true},
+		{data: map[string]interface{}{"roles": []string{"user", "admin"}}, expected: false},
+	} {
+		if res := rejecter.Reject(tc.data); res != tc.expected {
+			t.Errorf("%+v => unexpected response %v", tc.data, res)
+		}
+	}
+
+	if jwtRejecter := NewRejecter(logging.NoOp, cfg); jwtRejecter == nil || len(jwtRejecter.rules.Load().evaluators) != 1 {
+		t.Error("unexpected JWT rejecter")
+	}
+}
+
+func TestRejecter_now(t *testing.T) {
+	timeNow = func() time.Time {
+		return time.Date(2018, 12, 10, 0, 0, 0, 0, time.UTC)
+	}
+	defer func() { timeNow = time.Now }()
+
+	for _, expr := range []string{
+		"has(JWT.sub) && now_str == '2018-12-10T00:00:00Z'",
+		"has(JWT.sub) && timestamp(now) == now && timestamp(now_str) == now",
+		"has(JWT.sub) && now.getHours('Europe/Madrid') == 1",
+		"has(JWT.sub) && now.isWeekday('Europe/Madrid') && !now.isWeekday('America/New_York')",
+		"has(JWT.sub) && now.inTimeRange('18:00', '20:00', 'America/New_York')",
+		"has(JWT.sub) && now.inTimeRange('22:00', '06:00', 'UTC') && !now.inTimeRange('09:00', '17:00', 'UTC')",
+	} {
+		rejecter := NewRejecter(logging.NoOp, &config.EndpointConfig{
+			Endpoint: "/",
+			ExtraConfig: config.ExtraConfig{
+				internal.Namespace: []internal.InterpretableDefinition{{CheckExpression: expr}},
+			},
+		})
+		if rejecter == nil || len(rejecter.rules.Load().evaluators) != 1 {
+			t.Errorf("%s: unexpected rejecter", expr)
+			continue
+		}
+		if rejecter.Reject(map[string]interface{}{"sub": "1234"}) {
+			t.Errorf("%s: unexpected rejection", expr)
+		}
+	}
+
+	rejecter := NewRejecter(logging.NoOp, &config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "has(JWT.sub) && now.isWeekday('Unknown/Zone')"},
+			},
+		},
+	})
+	if rejecter == nil || !rejecter.Reject(map[string]interface{}{"sub": "1234"}) {
+		t.Error("the unknown time zone should reject the request")
+	}
+}
+
+func TestRejecter_audit(t *testing.T) {
+	rejecter := NewRejecter(logging.NoOp, &config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{Name: "audited", CheckExpression: "JWT.role == 'admin'", Mode: internal.AuditMode},
+				{CheckExpression: "has(JWT.sub)"},
+			},
+		},
+	})
+	if rejecter == nil {
+		t.Error("nil rejecter")
+		return
+	}
+
+	for _, tc := range []struct {
+		data     map[string]interface{}
+		expected bool
+	}{
+		{data: map[string]interface{}{"sub": "foo", "role": "admin"}},
+		{data: map[string]interface{}{"sub": "foo", "role": "user"}},
+		{data: map[string]interface{}{"sub": "foo"}},
+		{data: map[string]interface{}{"role": "admin"}, expected: true},
+	} {
+		if res := rejecter.Reject(tc.data); res != tc.expected {
+			t.Errorf("%+v => unexpected response %v", tc.data, res)
+		}
+	}
+}
+
+func TestRejecter_groups(t *testing.T) {
+	rejecter := NewRejecter(logging.NoOp, &config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: internal.Config{
+				NamedRules: map[string]internal.InterpretableDefinition{
+					"admin":   {CheckExpression: "JWT.role == 'admin'"},
+					"weekday": {CheckExpression: "now.getDayOfWeek() in [1, 2, 3, 4, 5]"},
+				},
+				Definitions: []internal.InterpretableDefinition{
+					{Any: []internal.Condition{{Ref: "admin"}, {Ref: "weekday"}}},
+				},
+			},
+		},
+	})
+	if rejecter == nil {
+		t.Error("nil rejecter")
+		return
+	}
+
+	defer func() { timeNow = time.Now }()
+	for _, tc := range []struct {
+		day      int
+		data     map[string]interface{}
+		expected bool
+	}{
+		{day: 10, data: map[string]interface{}{"role": "user"}},
+		{day: 9, data: map[string]interface{}{"role": "admin"}},
+		{day: 9, data: map[string]interface{}{"role": "user"}, expected: true},
+		{day: 9, data: map[string]interface{}{}, expected: true},
+	} {
+		timeNow = func() time.Time { return time.Date(2018, 12, tc.day, 0, 0, 0, 0, time.UTC) }
+		if res := rejecter.Reject(tc.data); res != tc.expected {
+			t.Errorf("%+v => unexpected response %v", tc.data, res)
+		}
+	}
+}
+
+func TestNewClaimsRejecter_strictProxies(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{CheckExpression: "req_method == 'GET'"},
+				{CheckExpression: "'admin' in apikey.roles"},
+				{CheckExpression: "cert.cn == 'gateway'"},
+				{Name: "mixed", Any: []internal.Condition{{Definition: &internal.InterpretableDefinition{CheckExpression: "has(cert.cn)"}}}},
+			},
+		},
+	}
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return proxy.NoopProxy, nil
+	})
+
+	if _, err := ProxyFactory(logging.NoOp, pf, WithStrictMode(true)).New(cfg); err == nil {
+		t.Error("expecting an error checking the undeclared claims variables")
+	}
+
+	opts := []Option{WithStrictMode(true), WithClaimsVariables("apikey", "cert")}
+	prxy, err := ProxyFactory(logging.NoOp, pf, opts...).New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := prxy(context.Background(), &proxy.Request{Method: "GET"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	l := &fatalLogger{Logger: logging.NoOp}
+	if r := NewRejecter(l, cfg, opts...); l.fatal || (r != nil && len(r.rules.Load().evaluators) > 0) {
+		t.Errorf("unexpected JWT rejecter: %v", r)
+	}
+
+	r := NewClaimsRejecter(l, cfg, "apikey", opts...)
+	if r == nil || l.fatal {
+		t.Fatal("unable to build the rejecter")
+	}
+	if len(r.rules.Load().evaluators) != 1 {
+		t.Errorf("unexpected evaluators: %d", len(r.rules.Load().evaluators))
+	}
+	if r.Reject(map[string]interface{}{"roles": []interface{}{"admin"}}) {
+		t.Error("the admin should not be rejected")
+	}
+	if !r.Reject(map[string]interface{}{"roles": []interface{}{"user"}}) {
+		t.Error("the user should be rejected")
+	}
+
+	if r := NewClaimsRejecter(l, cfg, "cert", opts...); r == nil || l.fatal || len(r.rules.Load().evaluators) != 2 {
+		t.Errorf("unexpected cert rejecter: %v", r)
+	}
+}
@@ -0,0 +1,283 @@
+package cel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/krakend/krakend-cel/v2/internal"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/logging"
+	"github.com/luraproject/lura/v2/proxy"
+)
+
+// RuleSource provides rules at runtime, replacing the ones declared in the extra config of the
+// endpoints, backends and rejecters without restarting the gateway. The rules are declared with
+// the same formats accepted by the extra config and they are keyed by EndpointKey or BackendKey.
+//
+// New rules are always validated in strict mode before swapping them, so the previous rules
+// are kept if any of them fails to compile
+type RuleSource struct {
+	l logging.Logger
+
+	mu      sync.Mutex
+	rules   map[string]interface{}
+	targets map[string][]*reloadable
+}
+
+// NewRuleSource returns an empty rule source. Use it with the WithRuleSource option
+func NewRuleSource(l logging.Logger) *RuleSource {
+	return &RuleSource{
+		l:       l,
+		rules:   map[string]interface{}{},
+		targets: map[string][]*reloadable{},
+	}
+}
+
+// EndpointKey returns the key of the rules of an endpoint, as "METHOD /endpoint"
+func EndpointKey(cfg *config.EndpointConfig) string {
+	return strings.ToUpper(cfg.Method) + " " + cfg.Endpoint
+}
+
+// BackendKey returns the key of the rules of a backend, as "METHOD /endpoint /url_pattern".
+// The backends of an endpoint sharing the same URL pattern share their rules
+func BackendKey(cfg *config.Backend) string {
+	return strings.ToUpper(cfg.ParentEndpointMethod) + " " + cfg.ParentEndpoint + " " + cfg.URLPattern
+}
+
+// ErrUnknownKey is returned by Update and Replace for the rules of a key without any registered
+// endpoint, backend or rejecter
+var ErrUnknownKey = errors.New("cel: no endpoint or backend registered with the key")
+
+// Update replaces the rules of the key. A nil value restores the rules of the extra config.
+// Once the pipes are built, the rules of unknown keys are rejected with ErrUnknownKey
+func (s *RuleSource) Update(key string, rules interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := make(map[string]interface{}, len(s.rules)+1)
+	for k, v := range s.rules {
+		next[k] = v
+	}
+	if rules == nil {
+		delete(next, key)
+	} else {
+		next[key] = rules
+	}
+	return s.apply(next, []string{key})
+}
+
+// Replace replaces the whole set of rules. The keys not present in the new set are restored
+// to the rules of their extra config. Nothing is swapped if any of the rules is not valid or,
+// once the pipes are built, if any of the keys is unknown
+func (s *RuleSource) Replace(rules map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(rules)+len(s.rules))
+	for k := range rules {
+		keys = append(keys, k)
+	}
+	for k := range s.rules {
+		if _, ok := rules[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	next := make(map[string]interface{}, len(rules))
+	for k, v := range rules {
+		next[k] = v
+	}
+	return s.apply(next, keys)
+}
+
+// apply builds the proxies of the updated keys and, if all of them are valid, swaps them and
+// stores the new set of rules
+func (s *RuleSource) apply(rules map[string]interface{}, keys []string) error {
+	sort.Strings(keys)
+	var swaps []func()
+	var errs []error
+	for _, key := range keys {
+		// the rules loaded before building the pipes are kept until their targets are registered
+		if rules[key] != nil && len(s.targets[key]) == 0 && len(s.targets) > 0 {
+			errs = append(errs, fmt.Errorf("%s: %w", key, ErrUnknownKey))
+			continue
+		}
+		for _, t := range s.targets[key] {
+			swap, err := t.build(rules[key])
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+				continue
+			}
+			swaps = append(swaps, swap)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	for _, swap := range swaps {
+		swap()
+	}
+	s.rules = rules
+	return nil
+}
+
+// Load replaces the whole set of rules with the content of a JSON file, or of all the JSON
+// files of a directory, mapping the keys to their rules
+func (s *RuleSource) Load(path string) error {
+	rules, err := readRules(path)
+	if err != nil {
+		return err
+	}
+	return s.Replace(rules)
+}
+
+// Watch loads the rules from the file or directory and reloads them on every change until the
+// context is cancelled. The reload failures are logged and the previous rules are kept
+func (s *RuleSource) Watch(ctx context.Context, path string) error {
+	if err := s.Load(path); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	dir := path
+	if !info.IsDir() {
+		// the parent directory is watched, so the editors replacing the file are supported
+		dir = filepath.Dir(path)
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(dir); err != nil {
+		w.Close()
+		return err
+	}
+
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if !info.IsDir() && filepath.Clean(event.Name) != filepath.Clean(path) {
+					continue
+				}
+				if err := s.Load(path); err != nil {
+					s.l.Error("[CEL] Unable to reload the rules from", path+":", err.Error())
+					continue
+				}
+				s.l.Info("[CEL] Rules reloaded from", path)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				s.l.Warning("[CEL] Error watching", path+":", err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+// register adds a target of the key. If the source already has rules for the key, they are
+// applied to the target
+func (s *RuleSource) register(key string, build func(interface{}) (func(), error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.targets[key] = append(s.targets[key], &reloadable{build: build})
+	if rules, ok := s.rules[key]; ok {
+		if swap, err := build(rules); err != nil {
+			s.l.Error("[CEL]", key+":", "Unable to apply the rules of the source:", err.Error())
+		} else {
+			swap()
+		}
+	}
+}
+
+// registerProxy wraps the proxy, so its rules can be replaced by the source
+func (s *RuleSource) registerProxy(key string, p proxy.Proxy, build func(interface{}) (proxy.Proxy, error)) proxy.Proxy {
+	current := &atomic.Pointer[proxy.Proxy]{}
+	current.Store(&p)
+	s.register(key, func(rules interface{}) (func(), error) {
+		np, err := build(rules)
+		if err != nil {
+			return nil, err
+		}
+		return func() { current.Store(&np) }, nil
+	})
+
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		return (*current.Load())(ctx, r)
+	}
+}
+
+// reloadable is a proxy or a rejecter whose rules can be replaced by the source
+type reloadable struct {
+	// build compiles the given rules, restoring the ones of the extra config for nil rules, and
+	// returns the function swapping them
+	build func(interface{}) (func(), error)
+}
+
+// reloadBuilder returns the function compiling the rules of the source for a pipe, the backend
+// one when the backend is not nil. The rules are always compiled in strict mode, so invalid
+// updates are rejected
+func reloadBuilder(original proxy.Proxy, obs observer, next proxy.Proxy, o options, backend *config.Backend) func(interface{}) (proxy.Proxy, error) {
+	return func(rules interface{}) (proxy.Proxy, error) {
+		if rules == nil {
+			return original, nil
+		}
+		def, ok := internal.ConfigGetter(config.ExtraConfig{internal.Namespace: rules})
+		if !ok {
+			return nil, errWrongConfig
+		}
+		strict := true
+		def.Strict = &strict
+		return newProxy(obs, def, next, o, backend)
+	}
+}
+
+func readRules(path string) (map[string]interface{}, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*.json")); err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+	}
+
+	rules := map[string]interface{}{}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var content map[string]interface{}
+		if err := json.Unmarshal(b, &content); err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		for k, v := range content {
+			rules[k] = v
+		}
+	}
+	return rules, nil
+}
@@ -0,0 +1,196 @@
+package cel
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krakend/krakend-cel/v2/internal"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/logging"
+	"github.com/luraproject/lura/v2/proxy"
+)
+
+func TestRuleSource_Update(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	source := NewRuleSource(logging.NoOp)
+
+	endpoint := &config.EndpointConfig{
+		Endpoint: "/foo",
+		Method:   "GET",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []interface{}{map[string]interface{}{"check_expr": "req_method == 'GET'"}},
+		},
+	}
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse), WithRuleSource(source)).New(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertAllowed := func(name string, params map[string]string, allowed bool) {
+		t.Helper()
+		if _, err := prxy(context.Background(), &proxy.Request{Method: "GET", Params: params}); allowed != (err == nil) {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+
+	assertAllowed("initial", map[string]string{"Id": "42"}, true)
+
+	if err := source.Update(EndpointKey(endpoint), []interface{}{
+		map[string]interface{}{"check_expr": "int(req_params.Id) < 10"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assertAllowed("updated", map[string]string{"Id": "42"}, false)
+	assertAllowed("updated", map[string]string{"Id": "1"}, true)
+
+	if err := source.Update(EndpointKey(endpoint), []interface{}{
+		map[string]interface{}{"check_expr": "req_params.Id == 1"},
+	}); err == nil {
+		t.Error("expecting error")
+	}
+	assertAllowed("invalid update", map[string]string{"Id": "42"}, false)
+	assertAllowed("invalid update", map[string]string{"Id": "1"}, true)
+
+	if err := source.Update("GET /typo", []interface{}{
+		map[string]interface{}{"check_expr": "req_method == 'POST'"},
+	}); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := source.Replace(map[string]interface{}{
+		EndpointKey(endpoint): []interface{}{map[string]interface{}{"check_expr": "req_method == 'POST'"}},
+		"GET /typo":           []interface{}{map[string]interface{}{"check_expr": "req_method == 'POST'"}},
+	}); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assertAllowed("unknown key", map[string]string{"Id": "42"}, false)
+	assertAllowed("unknown key", map[string]string{"Id": "1"}, true)
+
+	if err := source.Update(EndpointKey(endpoint), nil); err != nil {
+		t.Fatal(err)
+	}
+	assertAllowed("restored", map[string]string{"Id": "42"}, true)
+}
+
+func TestRuleSource_rejecter(t *testing.T) {
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	source := NewRuleSource(logging.NoOp)
+	endpoint := &config.EndpointConfig{Endpoint: "/foo", Method: "GET"}
+
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse), WithRuleSource(source)).New(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejecter := NewRejecter(logging.NoOp, endpoint, WithRuleSource(source))
+	if rejecter == nil {
+		t.Fatal("the rejecter must be registered in the source")
+	}
+	if rejecter.Reject(map[string]interface{}{"role": "user"}) {
+		t.Error("the initial rejecter should accept all the requests")
+	}
+
+	if err := source.Update(EndpointKey(endpoint), []interface{}{
+		map[string]interface{}{"check_expr": "JWT.role == 'admin'"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !rejecter.Reject(map[string]interface{}{"role": "user"}) {
+		t.Error("the reloaded JWT rule should reject the request")
+	}
+	if rejecter.Reject(map[string]interface{}{"role": "admin"}) {
+		t.Error("the reloaded JWT rule should accept the request")
+	}
+	// the proxy skips the JWT rules, as they are evaluated by the rejecter
+	if _, err := prxy(context.Background(), &proxy.Request{Method: "GET"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := source.Update(EndpointKey(endpoint), []interface{}{
+		map[string]interface{}{"check_expr": "JWT.role =="},
+	}); err == nil {
+		t.Error("expecting error")
+	}
+	if !rejecter.Reject(map[string]interface{}{"role": "user"}) {
+		t.Error("the previous rules should be kept after an invalid update")
+	}
+
+	if err := source.Update(EndpointKey(endpoint), nil); err != nil {
+		t.Fatal(err)
+	}
+	if rejecter.Reject(map[string]interface{}{"role": "user"}) {
+		t.Error("the restored rejecter should accept all the requests")
+	}
+}
+
+func TestRuleSource_Watch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.json")
+	if err := os.WriteFile(path, []byte(`{"GET /foo": [{"check_expr": "req_params.Id == '1'"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := NewRuleSource(logging.NoOp)
+	if err := source.Watch(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	bf := BackendFactory(logging.NoOp, func(_ *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return expectedResponse, nil
+		}
+	}, WithRuleSource(source))
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse), WithRuleSource(source)).New(&config.EndpointConfig{
+		Endpoint: "/foo",
+		Method:   "GET",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := bf(&config.Backend{URLPattern: "/bar", ParentEndpoint: "/foo", ParentEndpointMethod: "GET"})
+
+	allowed := func(p proxy.Proxy, id string) bool {
+		_, err := p(context.Background(), &proxy.Request{Method: "GET", Params: map[string]string{"Id": id}})
+		return err == nil
+	}
+
+	if !allowed(prxy, "1") || allowed(prxy, "2") {
+		t.Error("the initial rules were not applied")
+	}
+	if !allowed(backend, "2") {
+		t.Error("unexpected backend rules")
+	}
+
+	waitFor := func(name string, cond func() bool) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if cond() {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Errorf("%s: timeout waiting for the reload", name)
+	}
+
+	if err := os.WriteFile(path, []byte(`{
+		"GET /foo": [{"check_expr": "req_params.Id == '2'"}],
+		"GET /foo /bar": [{"check_expr": "req_params.Id != '2'"}]
+	}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("reload", func() bool { return allowed(prxy, "2") && !allowed(backend, "2") })
+
+	if err := os.WriteFile(path, []byte(`{"GET /foo": [{"check_expr": "req_params.Id == 3"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if !allowed(prxy, "2") || allowed(backend, "2") {
+		t.Error("the invalid rules replaced the previous ones")
+	}
+}
@@ -0,0 +1,53 @@
+package cel
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/krakend/krakend-cel/v2/internal"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func newTracer(t trace.Tracer) trace.Tracer {
+	if t == nil {
+		return noop.NewTracerProvider().Tracer(internal.Namespace)
+	}
+	return t
+}
+
+// startSpan starts the span covering the evaluation of the rules of the observed phase
+func (o observer) startSpan(ctx context.Context) (context.Context, trace.Span) {
+	return o.tracer.Start(ctx, "cel "+o.phase, trace.WithAttributes(o.attrs...))
+}
+
+// endSpan ends the span of a phase, flagging it as failed if the request was aborted
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// addRuleEvent records the evaluation of a rule as an event of the span in the context
+func addRuleEvent(ctx context.Context, attrs []attribute.KeyValue, res ref.Val, det *cel.EvalDetails) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	if res != nil {
+		if b, ok := res.Value().(bool); ok {
+			attrs = append(attrs, attribute.Bool("krakend.cel.result", b))
+		} else {
+			attrs = append(attrs, attribute.String("krakend.cel.result_type", fmt.Sprintf("%v", res.Type())))
+		}
+	}
+	if det != nil && det.ActualCost() != nil {
+		attrs = append(attrs, attribute.Int64("krakend.cel.cost", int64(*det.ActualCost())))
+	}
+	span.AddEvent("cel rule", trace.WithAttributes(attrs...))
+}
@@ -0,0 +1,81 @@
+package cel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/krakend/krakend-cel/v2/internal"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/logging"
+	"github.com/luraproject/lura/v2/proxy"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestProxyFactory_tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	expectedResponse := &proxy.Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}
+	prxy, err := ProxyFactory(logging.NoOp, dummyProxyFactory(expectedResponse), WithTracer(tracer)).New(&config.EndpointConfig{
+		Endpoint: "/foo",
+		ExtraConfig: config.ExtraConfig{
+			internal.Namespace: []internal.InterpretableDefinition{
+				{Name: "only-get", CheckExpression: "req_method == 'GET'"},
+				{CheckExpression: "resp_data.ok"},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	prxy(ctx, &proxy.Request{Method: "GET"})
+	prxy(ctx, &proxy.Request{Method: "POST"})
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 4 {
+		t.Errorf("unexpected number of spans: %d", len(spans))
+		return
+	}
+
+	for i, tc := range []struct {
+		name   string
+		status codes.Code
+		rule   string
+		result bool
+	}{
+		{name: "cel pre", status: codes.Unset, rule: "only-get", result: true},
+		{name: "cel post", status: codes.Unset, rule: "#1", result: true},
+		{name: "cel pre", status: codes.Error, rule: "only-get", result: false},
+	} {
+		span := spans[i]
+		if span.Name() != tc.name {
+			t.Errorf("#%d: unexpected span name %s", i, span.Name())
+		}
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("#%d: unexpected parent span", i)
+		}
+		if span.Status().Code != tc.status {
+			t.Errorf("#%d: unexpected status %v", i, span.Status())
+		}
+		if len(span.Events()) != 1 {
+			t.Errorf("#%d: unexpected number of events: %d", i, len(span.Events()))
+			continue
+		}
+		attrs := map[string]interface{}{}
+		for _, a := range span.Events()[0].Attributes {
+			attrs[string(a.Key)] = a.Value.AsInterface()
+		}
+		if attrs["krakend.cel.rule"] != tc.rule || attrs["krakend.cel.result"] != tc.result {
+			t.Errorf("#%d: unexpected attributes %v", i, attrs)
+		}
+		if _, ok := attrs["krakend.cel.cost"]; !ok {
+			t.Errorf("#%d: cost not recorded", i)
+		}
+	}
+}